@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// localArchive is a gzipped tarball of the source, ready to upload.
+type localArchive struct {
+	// Size is the archive's length in bytes, and Checksum its digest in the
+	// "SHA256:<hex>" form Heroku expects.
+	Size     int64
+	Checksum string
+
+	// Files is the number of regular files in the archive.
+	Files int
+
+	// Open returns a reader for the whole archive. It is called again for
+	// every upload attempt.
+	Open func() (io.ReadCloser, error)
+
+	close func() error
+}
+
+// Close releases anything the archive holds on disk. It is safe to call on
+// every path out of a build.
+func (a *localArchive) Close() error {
+	if a == nil || a.close == nil {
+		return nil
+	}
+	return a.close()
+}
+
+// createLocalArchive tars source for upload. By default the archive is
+// written to a temp file; when streaming it is never stored, and is instead
+// tarred once to learn its size and checksum, since presigned S3 URLs don't
+// accept chunked uploads, and again for every upload attempt.
+func (b *Builder) createLocalArchive(log hclog.Logger, source, prefix string) (*localArchive, error) {
+	log.Info("Tar started", "source", source, "stream", b.config.Stream)
+
+	ignore, err := newIgnoreRules(source, b.config.Exclude, b.config.Include, b.config.Gitignore)
+	if err != nil {
+		return nil, err
+	}
+	files := 0
+	opts := TarOptions{
+		Ignore:        ignore.Ignored,
+		Deterministic: true,
+		Prefix:        prefix,
+		OnFile:        func(string) { files++ },
+	}
+
+	var a *localArchive
+	if b.config.Stream {
+		a, err = streamArchive(source, opts)
+	} else {
+		a, err = tempArchive(source, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.Files = files
+	log.Info("Tar finished", "source", source, "files", a.Files, "size", a.Size, "checksum", a.Checksum)
+	return a, nil
+}
+
+func tempArchive(source string, opts TarOptions) (*localArchive, error) {
+	tf, err := ioutil.TempFile("", "source-tar.")
+	if err != nil {
+		return nil, err
+	}
+	a := &localArchive{
+		Open: func() (io.ReadCloser, error) {
+			if _, err := tf.Seek(0, 0); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(tf), nil
+		},
+		close: func() error {
+			tf.Close()
+			return os.Remove(tf.Name())
+		},
+	}
+
+	hash := sha256.New()
+	cw := &countWriter{}
+	if err := Tar(source, opts, tf, hash, cw); err != nil {
+		a.Close()
+		return nil, err
+	}
+	a.Size = cw.n
+	a.Checksum = checksumString(hash.Sum(nil))
+	return a, nil
+}
+
+func streamArchive(source string, opts TarOptions) (*localArchive, error) {
+	hash := sha256.New()
+	cw := &countWriter{}
+	if err := Tar(source, opts, hash, cw); err != nil {
+		return nil, err
+	}
+
+	a := &localArchive{
+		Size:     cw.n,
+		Checksum: checksumString(hash.Sum(nil)),
+	}
+	// only the first pass counts files
+	opts.OnFile = nil
+	a.Open = func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			hash := sha256.New()
+			err := Tar(source, opts, pw, hash)
+			if err == nil && checksumString(hash.Sum(nil)) != a.Checksum {
+				err = fmt.Errorf("%s changed while it was being uploaded", source)
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, nil
+	}
+	return a, nil
+}
+
+func checksumString(sum []byte) string {
+	return "SHA256:" + hex.EncodeToString(sum)
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// TarOptions controls which files Tar writes and how.
+type TarOptions struct {
+	// Ignore is called with each slash-separated path relative to the source
+	// and leaves it out, along with everything below it, when it returns true.
+	Ignore func(path string, isDir bool) bool
+
+	// Prefix, if set, is prepended to every entry name, and written as a
+	// directory entry of its own.
+	Prefix string
+
+	// OnFile, if set, is called with the name of each regular file written.
+	OnFile func(name string)
+
+	// Deterministic makes identical trees produce identical archives by
+	// fixing mtimes, clearing owners and normalizing permissions to 0644, or
+	// 0755 for directories and executables.
+	Deterministic bool
+}
+
+// archiveModTime is the mtime of every entry in a deterministic archive.
+var archiveModTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Tar takes a source and variable writers and walks 'source' writing each file
+// found to the tar writer; the purpose for accepting multiple writers is to allow
+// for multiple outputs (for example a file, or md5 hash)
+func Tar(src string, opts TarOptions, writers ...io.Writer) error {
+	// ensure the src actually exists before trying to tar it
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("Unable to tar files - %v", err.Error())
+	}
+
+	mw := io.MultiWriter(writers...)
+
+	gzw := gzip.NewWriter(mw)
+	tw := tar.NewWriter(gzw)
+
+	if opts.Prefix != "" {
+		header := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     opts.Prefix + "/",
+			Mode:     0755,
+			ModTime:  archiveModTime,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+	}
+
+	// walk path; Walk visits entries in lexical order, so the archive order
+	// doesn't depend on the filesystem
+	err := filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+
+		// return on any error
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if opts.Ignore != nil && opts.Ignore(rel, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// keep directories and symlinks, but skip devices, sockets and pipes
+		var link string
+		switch {
+		case fi.Mode().IsRegular(), fi.IsDir():
+		case fi.Mode()&os.ModeSymlink != 0:
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+
+		// create a new dir/file header
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+
+		// update the name to correctly reflect the desired destination when untaring
+		header.Name = rel
+		if opts.Prefix != "" {
+			header.Name = opts.Prefix + "/" + rel
+		}
+		if fi.IsDir() {
+			header.Name += "/"
+		}
+
+		if opts.Deterministic {
+			normalizeHeader(header)
+		}
+
+		// write the header
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		// open files for taring
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+
+		// copy file data into tar writer
+		if _, err := io.Copy(tw, f); err != nil {
+			f.Close()
+			return err
+		}
+
+		// manually close here after each file operation; defering would cause each file close
+		// to wait until all operations have completed.
+		f.Close()
+
+		if opts.OnFile != nil {
+			opts.OnFile(header.Name)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// close explicitly rather than deferring, so a failure to flush the
+	// last blocks isn't mistaken for a complete archive
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// normalizeHeader strips everything from header that depends on the host
+// rather than the file contents.
+func normalizeHeader(header *tar.Header) {
+	header.ModTime = archiveModTime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	header.Uid, header.Gid = 0, 0
+	header.Uname, header.Gname = "", ""
+
+	switch {
+	case header.Typeflag == tar.TypeSymlink:
+		header.Mode = 0777
+	case header.Typeflag == tar.TypeDir || header.Mode&0111 != 0:
+		header.Mode = 0755
+	default:
+		header.Mode = 0644
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestTarDeterministic(t *testing.T) {
+	dir := writeSource(t, nil)
+
+	var first, second bytes.Buffer
+	if err := Tar(dir, TarOptions{Deterministic: true}, &first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Touch every file so only mtimes differ.
+	later := time.Now().Add(time.Hour)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, later, later)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Tar(dir, TarOptions{Deterministic: true}, &second); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("archives of identical trees differ")
+	}
+}
+
+func TestTarPreservesLinksDirsAndModes(t *testing.T) {
+	dir := writeSource(t, map[string]string{
+		"bin/start": "#!/bin/sh\n",
+		"index.js":  "",
+	})
+	if err := os.Chmod(filepath.Join(dir, "bin/start"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("index.js", filepath.Join(dir, "main.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Tar(dir, TarOptions{Deterministic: true}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]*tar.Header{}
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers[h.Name] = h
+	}
+
+	if h := headers["empty/"]; h == nil || h.Typeflag != tar.TypeDir {
+		t.Errorf("expected an entry for the empty directory, got %+v", h)
+	}
+	if h := headers["main.js"]; h == nil || h.Typeflag != tar.TypeSymlink || h.Linkname != "index.js" {
+		t.Errorf("expected main.js to be a symlink to index.js, got %+v", h)
+	}
+	if h := headers["bin/start"]; h == nil || h.Mode != 0755 {
+		t.Errorf("expected bin/start to stay executable, got %+v", h)
+	}
+	if h := headers["index.js"]; h == nil || h.Mode != 0644 || h.Uid != 0 || !h.ModTime.Equal(archiveModTime) {
+		t.Errorf("expected a normalized header for index.js, got %+v", h)
+	}
+}
+
+func TestCreateLocalArchiveModes(t *testing.T) {
+	dir := writeSource(t, nil)
+	b := &Builder{}
+
+	temp, err := b.createLocalArchive(hclog.NewNullLogger(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.config.Stream = true
+	stream, err := b.createLocalArchive(hclog.NewNullLogger(), dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	if temp.Files != 3 || stream.Files != 3 {
+		t.Errorf("expected 3 files, counted %d and %d", temp.Files, stream.Files)
+	}
+	if temp.Size != stream.Size || temp.Checksum != stream.Checksum {
+		t.Errorf("streamed archive (%d, %s) differs from temp file (%d, %s)", stream.Size, stream.Checksum, temp.Size, temp.Checksum)
+	}
+	for _, a := range []*localArchive{temp, stream} {
+		// Every attempt must see the whole archive.
+		for i := 0; i < 2; i++ {
+			r, err := a.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(body)) != a.Size || checksumString(sha256Sum(body)) != a.Checksum {
+				t.Errorf("attempt %d read %d bytes, want %d", i, len(body), a.Size)
+			}
+		}
+	}
+
+	if err := temp.Close(); err != nil {
+		t.Fatalf("removing temp file: %s", err)
+	}
+	if _, err := temp.Open(); err == nil {
+		t.Error("temp archive still readable after Close")
+	}
+}
+
+func sha256Sum(b []byte) []byte {
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
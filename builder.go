@@ -1,17 +1,20 @@
 package main
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
-	"runtime/debug"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/fanatic/waypoint-plugin-heroku/heroku"
 	"github.com/hashicorp/go-hclog"
@@ -19,6 +22,7 @@ import (
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
 	herokuSDK "github.com/heroku/heroku-go/v5"
 	"github.com/paketo-buildpacks/procfile/procfile"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type BuildConfig struct {
@@ -26,6 +30,51 @@ type BuildConfig struct {
 	Source   string `hcl:"source,optional"`
 	Pipeline string `hcl:"pipeline,optional"`
 	App      string `hcl:"app,optional"`
+	APIKey   string `hcl:"api_key,optional"`
+
+	// URL is the HTTPS tarball built when From is "url". Repo ("owner/name")
+	// and Ref, a branch, tag or commit defaulting to the default branch, are
+	// built when From is "git"; GitHubToken is needed for private repos.
+	URL         string `hcl:"url,optional"`
+	Repo        string `hcl:"repo,optional"`
+	Ref         string `hcl:"ref,optional"`
+	GitHubToken string `hcl:"github_token,optional"`
+
+	// BuildApp owns the builds and slugs when set, so they can be released
+	// to App or any other app in the same account or team.
+	BuildApp string `hcl:"build_app,optional"`
+
+	// Exclude and Include are gitignore-style patterns applied after
+	// .slugignore (and .gitignore, if Gitignore is set) when archiving.
+	Exclude   []string `hcl:"exclude,optional"`
+	Include   []string `hcl:"include,optional"`
+	Gitignore bool     `hcl:"gitignore,optional"`
+
+	// Stream uploads the archive as it is created instead of writing it to
+	// a temp file first, at the cost of tarring the source twice.
+	Stream bool `hcl:"stream,optional"`
+
+	// DisableCache always uploads and builds the source, even when a
+	// previous build of the same archive succeeded.
+	DisableCache bool `hcl:"disable_cache,optional"`
+
+	// Stack is the stack to build on, defaulting to the app's build stack.
+	// Apps on the container stack are switched to it (or Heroku's default
+	// stack) for the build, and switched back afterwards if RestoreStack is
+	// set.
+	Stack        string `hcl:"stack,optional"`
+	RestoreStack bool   `hcl:"restore_stack,optional"`
+
+	// Buildpacks, if set, are used in order for source builds instead of
+	// the app's buildpacks, given as URLs or buildpack registry names.
+	// PersistBuildpacks also installs them on the app once a build succeeds.
+	Buildpacks        []string `hcl:"buildpacks,optional"`
+	PersistBuildpacks bool     `hcl:"persist_buildpacks,optional"`
+
+	// Env is set as config vars on the build app before a source build, as
+	// Heroku builds read their environment from the app. Changing a config
+	// var creates a release on that app, which is why BuildApp is advised.
+	Env map[string]string `hcl:"env,optional"`
 }
 
 type Builder struct {
@@ -43,14 +92,10 @@ func (b *Builder) BuildFunc() interface{} {
 	return b.build
 }
 
-func (b *Builder) build(ctx context.Context, ui terminal.UI, job *component.JobInfo, src *component.Source, log hclog.Logger) (*Artifact, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error("Panic: %s %s", r, string(debug.Stack()))
-		}
-	}()
+func (b *Builder) build(ctx context.Context, ui terminal.UI, job *component.JobInfo, src *component.Source, log hclog.Logger) (artifact *Artifact, err error) {
+	defer recoverPanic(log, &err)
 
-	h, err := heroku.New()
+	h, err := heroku.New(b.config.APIKey)
 	if err != nil {
 		return nil, err
 	}
@@ -69,34 +114,69 @@ func (b *Builder) build(ctx context.Context, ui terminal.UI, job *component.JobI
 		}
 
 		step := sg.Add("Archiving source...")
-		tf, err := b.createLocalArchive(log, b.config.Source)
+		archive, err := b.createLocalArchive(log, b.config.Source, "")
 		if err != nil {
 			step.Abort()
 			return nil, err
 		}
-		defer os.Remove(tf.Name())
-		defer tf.Close()
+		defer archive.Close()
+		step.Update("Archived %d files (%s)", archive.Files, formatBytes(archive.Size))
 		step.Done()
 
-		step = sg.Add("Sending source to Heroku...")
-		sourceURL, err := b.createHerokuSource(ctx, h, log, tf)
+		return b.buildSource(ctx, ui, sg, log, h, &buildSource{
+			Checksum: archive.Checksum,
+			Version:  b.sourceVersion(job),
+			Commit:   gitCommit(b.config.Source),
+			Cache:    true,
+			Upload: func(step terminal.Step) (string, error) {
+				return b.createHerokuSource(ctx, h, log, archive.withProgress(step, "Sending source to Heroku..."))
+			},
+		})
+	} else if b.config.From == "url" {
+		// Remote URLs may change under us, so their builds aren't cached.
+		return b.buildSource(ctx, ui, ui.StepGroup(), log, h, &buildSource{
+			URL:     b.config.URL,
+			Version: job.Id,
+		})
+	} else if b.config.From == "git" {
+		sg := ui.StepGroup()
+
+		step := sg.Add("Resolving %s on GitHub...", b.config.Repo)
+		token := b.config.GitHubToken
+		if token == "" {
+			token = os.Getenv(EnvGitHubToken)
+		}
+		commit, url, err := githubTarball(ctx, b.config.Repo, b.config.Ref, token)
 		if err != nil {
 			step.Abort()
 			return nil, err
 		}
+		step.Update("Resolved %s to %s", b.config.Repo, commit)
 		step.Done()
 
-		step = sg.Add("Building image...")
-		slugID, err := b.createHerokuBuild(ctx, h, sourceURL, job.Id, step.TermOutput())
+		return b.buildSource(ctx, ui, sg, log, h, &buildSource{
+			URL:     url,
+			Version: commit,
+			Commit:  commit,
+			Cache:   true,
+		})
+	} else if b.config.From == "existing" {
+		sg := ui.StepGroup()
+
+		step := sg.Add("Looking up the current release of %s...", b.existingApp())
+		artifact, err := b.existingArtifact(ctx, h)
 		if err != nil {
 			step.Abort()
 			return nil, err
 		}
+		if artifact.SlugID != "" {
+			step.Update("Using slug %s", artifact.SlugID)
+		} else {
+			step.Update("Using image %s", artifact.ContainerImageDigest)
+		}
 		step.Done()
 
-		return &Artifact{
-			SlugID: slugID,
-		}, nil
+		return artifact, nil
 	} else if b.config.From == "archive" {
 		sg := ui.StepGroup()
 
@@ -104,45 +184,254 @@ func (b *Builder) build(ctx context.Context, ui terminal.UI, job *component.JobI
 			b.config.Source = src.Path
 		}
 
-		step := sg.Add("Archiving slug...")
-		tf, err := b.createLocalArchive(log, b.config.Source)
+		step := sg.Add("Validating Procfile...")
+		processTypes, err := readProcessTypes(b.config.Source)
 		if err != nil {
+			step.Abort()
+			return nil, err
+		}
+		if err := validateProcessTypes(b.config.Source, processTypes); err != nil {
+			step.Abort()
 			return nil, err
 		}
-		defer os.Remove(tf.Name())
-		defer tf.Close()
 		step.Done()
 
+		step = sg.Add("Archiving slug...")
+		archive, err := b.createLocalArchive(log, b.config.Source, slugPrefix)
+		if err != nil {
+			step.Abort()
+			return nil, err
+		}
+		defer archive.Close()
+		step.Update("Archived %d files (%s)", archive.Files, formatBytes(archive.Size))
+		step.Done()
+
+		if archive.Size > maxSlugSize {
+			log.Warn("slug exceeds Heroku's size limit", "size", archive.Size, "limit", maxSlugSize)
+			ui.Output("Slug is %d MB, over Heroku's %d MB limit; the release will likely be rejected",
+				archive.Size>>20, maxSlugSize>>20, terminal.WithWarningStyle())
+		}
+
 		step = sg.Add("Sending slug to Heroku...")
-		slugID, err := b.createHerokuSlug(ctx, h, log, tf)
+		slug, err := b.createHerokuSlug(ctx, h, log, archive.withProgress(step, "Sending slug to Heroku..."), processTypes)
 		if err != nil {
+			step.Abort()
+			return nil, err
+		}
+		// Slugs don't say which app owns them.
+		app, err := h.AppInfo(ctx, b.buildApp())
+		if err != nil {
+			step.Abort()
 			return nil, err
 		}
 		step.Done()
 
 		return &Artifact{
-			SlugID: slugID,
+			App:       app.Name,
+			AppID:     app.ID,
+			SlugID:    slug.ID,
+			Stack:     slug.Stack.Name,
+			Commit:    stringValue(slug.Commit),
+			CreatedAt: timestamppb.New(slug.CreatedAt),
 		}, nil
 	}
 
-	return nil, fmt.Errorf("Must supply valid 'from' parameter: source")
+	return nil, fmt.Errorf("from must be one of %s, got %q", fromList(), b.config.From)
 }
 
-func (b *Builder) createLocalArchive(log hclog.Logger, source string) (*os.File, error) {
-	log.Info("Tar started", "source", source)
-	tf, err := ioutil.TempFile("", "source-tar.")
+// sourceVersion identifies the source of a build in the Heroku dashboard:
+// the git commit checked out in the source directory, or the job ID when
+// it isn't a git working tree.
+func (b *Builder) sourceVersion(job *component.JobInfo) string {
+	if commit := gitCommit(b.config.Source); commit != "" {
+		return commit
+	}
+	return job.Id
+}
+
+// gitCommit returns the commit checked out in dir, or "" if dir is not in a
+// git working tree or git isn't installed.
+func gitCommit(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "--verify", "HEAD").Output()
 	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// setBuildEnv sets the configured env as config vars on the build app.
+func (b *Builder) setBuildEnv(ctx context.Context, h *herokuSDK.Service) error {
+	current, err := h.ConfigVarInfoForApp(ctx, b.buildApp())
+	if err != nil {
+		return err
+	}
+
+	updates := map[string]*string{}
+	for k, v := range b.config.Env {
+		if c, ok := current[k]; !ok || c == nil || *c != v {
+			updates[k] = String(v)
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+
+	_, err = h.ConfigVarUpdate(ctx, b.buildApp(), updates)
+	return err
+}
+
+// envVersionSep separates a source version from the hash of the env it was
+// built with.
+const envVersionSep = "+env."
+
+// envVersion appends a hash of the configured env to version. Heroku doesn't
+// record the config vars a build ran with, so this is how findCachedBuild
+// tells builds of the same source under different env apart.
+func (b *Builder) envVersion(version string) string {
+	if len(b.config.Env) == 0 {
+		return version
+	}
+	keys := make([]string, 0, len(b.config.Env))
+	for k := range b.config.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sum := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(sum, "%s=%s\n", k, b.config.Env[k])
+	}
+	return version + envVersionSep + hex.EncodeToString(sum.Sum(nil))[:12]
+}
+
+// splitEnvVersion undoes envVersion, returning the source version and the
+// env hash, if any.
+func splitEnvVersion(version string) (source, env string) {
+	if i := strings.LastIndex(version, envVersionSep); i >= 0 {
+		return version[:i], version[i+len(envVersionSep):]
+	}
+	return version, ""
+}
+
+// buildApp is the app builds and slugs are created on.
+func (b *Builder) buildApp() string {
+	if b.config.BuildApp != "" {
+		return b.config.BuildApp
+	}
+	return b.config.App
+}
+
+// buildSource is the input to a Heroku build. Upload, if set, is called to
+// get URL once no cached build was found.
+type buildSource struct {
+	URL      string
+	Checksum string
+	Version  string
+	Commit   string
+	Cache    bool
+	Upload   func(step terminal.Step) (string, error)
+}
+
+// buildSource runs a Heroku build of src on the build app, reusing a
+// previous build of the same source when src.Cache allows it.
+func (b *Builder) buildSource(ctx context.Context, ui terminal.UI, sg terminal.StepGroup, log hclog.Logger, h *herokuSDK.Service, src *buildSource) (*Artifact, error) {
+	step := sg.Add("Checking build stack...")
+	stack, err := b.resolveStack(ctx, h)
+	if err != nil {
+		step.Abort()
 		return nil, err
 	}
+	step.Update("Building on %s", stack.Name)
+	step.Done()
 
-	if err := Tar(source, tf); err != nil {
+	if len(b.config.Env) > 0 {
+		step = sg.Add("Setting build environment...")
+		if err := b.setBuildEnv(ctx, h); err != nil {
+			step.Abort()
+			return nil, err
+		}
+		step.Done()
+	}
+
+	// Builds under a different env mustn't be reused, so it is part of
+	// the version that identifies them.
+	version := b.envVersion(src.Version)
+	if src.Cache && !b.config.DisableCache {
+		step = sg.Add("Checking for a previous build...")
+		cached, err := b.findCachedBuild(ctx, h, src.Checksum, version, stack.Name)
+		if err != nil {
+			step.Abort()
+			return nil, err
+		}
+		if cached != nil {
+			step.Update("Reusing slug from build %s", cached.ID)
+			step.Done()
+			if err := b.persistBuildpacks(ctx, h, sg); err != nil {
+				return nil, err
+			}
+			return &Artifact{
+				App:       b.buildApp(),
+				AppID:     cached.App.ID,
+				SlugID:    cached.Slug.ID,
+				Stack:     cached.Stack,
+				Commit:    src.Commit,
+				CreatedAt: timestamppb.New(cached.CreatedAt),
+			}, nil
+		}
+		step.Done()
+	}
+
+	sourceURL := src.URL
+	if src.Upload != nil {
+		step = sg.Add("Sending source to Heroku...")
+		sourceURL, err = src.Upload(step)
+		if err != nil {
+			step.Abort()
+			return nil, err
+		}
+		step.Done()
+	}
+
+	if stack.Switch {
+		step = sg.Add("Switching app to %s...", stack.Name)
+		if err := b.setBuildStack(ctx, h, stack.Name); err != nil {
+			step.Abort()
+			return nil, err
+		}
+		step.Done()
+
+		if b.config.RestoreStack {
+			defer func() {
+				if err := b.setBuildStack(ctx, h, stack.Previous); err != nil {
+					log.Warn("failed to restore build stack", "stack", stack.Previous, "error", err)
+					ui.Output("Could not switch app back to %s: %s", stack.Previous, err, terminal.WithWarningStyle())
+				}
+			}()
+		}
+	}
+
+	step = sg.Add("Building image...")
+	build, err := b.createHerokuBuild(ctx, h, sourceURL, src.Checksum, version, step.TermOutput())
+	if err != nil {
+		step.Abort()
+		return nil, err
+	}
+	step.Done()
+
+	if err := b.persistBuildpacks(ctx, h, sg); err != nil {
 		return nil, err
 	}
-	log.Info("Tar finished", "source", source)
-	return tf, nil
+
+	return &Artifact{
+		App:       b.buildApp(),
+		AppID:     build.App.ID,
+		SlugID:    build.Slug.ID,
+		Stack:     build.Stack,
+		Commit:    src.Commit,
+		CreatedAt: timestamppb.New(build.CreatedAt),
+	}, nil
 }
 
-func (b *Builder) createHerokuSource(ctx context.Context, h *herokuSDK.Service, log hclog.Logger, tf *os.File) (string, error) {
+func (b *Builder) createHerokuSource(ctx context.Context, h *herokuSDK.Service, log hclog.Logger, archive *localArchive) (string, error) {
 	source, err := h.SourceCreate(ctx)
 	if err != nil {
 		return "", err
@@ -152,189 +441,430 @@ func (b *Builder) createHerokuSource(ctx context.Context, h *herokuSDK.Service,
 		"source", source,
 	)
 
-	if _, err := tf.Seek(0, 0); err != nil {
-		return "", err
-	}
-	req, err := http.NewRequest("PUT", source.SourceBlob.PutURL, tf)
-	if err != nil {
-		return "", err
-	}
-	stat, err := tf.Stat()
-	if err != nil {
+	if err := heroku.PutBlob(ctx, source.SourceBlob.PutURL, archive.Size, archive.Open); err != nil {
 		return "", err
 	}
-	req.ContentLength = stat.Size()
+	log.Info("Source upload complete")
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+	return source.SourceBlob.GetURL, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+// defaultStack returns the stack Heroku currently gives new apps, which apps
+// on the container stack are switched to for a source build when no stack
+// is configured. It is looked up rather than fixed, as stacks are retired.
+func defaultStack(ctx context.Context, h *herokuSDK.Service) (string, error) {
+	var stacks []struct {
+		Name    string `json:"name"`
+		Default bool   `json:"default"`
+	}
+	if err := h.Get(ctx, &stacks, "/stacks", nil, nil); err != nil {
 		return "", err
 	}
+	for _, s := range stacks {
+		if s.Default {
+			return s.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no default stack found; set stack to build on an app on the container stack")
+}
 
-	log.Info("Source upload complete", "code", resp.StatusCode, "body", string(body))
-
-	return source.SourceBlob.GetURL, nil
+// buildStack is the stack a source build will run on.
+type buildStack struct {
+	Name string
+	// Switch is set when the app must be moved to Name before building,
+	// and Previous holds the stack it is moved from.
+	Switch   bool
+	Previous string
 }
 
-func (b *Builder) createHerokuBuild(ctx context.Context, h *herokuSDK.Service, sourceURL, sourceVersion string, w io.Writer) (string, error) {
-	// Force build stack back to heroku-18 in case we set it to container with a previous push
-	_, err := h.AppUpdate(ctx, b.config.App, herokuSDK.AppUpdateOpts{BuildStack: String("heroku-18")})
+// resolveStack works out which stack to build on without changing the app.
+// Only apps on the container stack are switched; for any other app a
+// configured stack must match, so builds never silently change the stack
+// of an app someone has moved.
+func (b *Builder) resolveStack(ctx context.Context, h *herokuSDK.Service) (*buildStack, error) {
+	app, err := h.AppInfo(ctx, b.buildApp())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	current := app.BuildStack.Name
+
+	if current == "container" {
+		name := b.config.Stack
+		if name == "" {
+			if name, err = defaultStack(ctx, h); err != nil {
+				return nil, err
+			}
+		}
+		return &buildStack{Name: name, Switch: name != current, Previous: current}, nil
+	}
+	if b.config.Stack != "" && b.config.Stack != current {
+		return nil, fmt.Errorf("app %s builds on %s, not the configured stack %s; change it with `heroku stack:set %s -a %s`",
+			b.buildApp(), current, b.config.Stack, b.config.Stack, b.buildApp())
+	}
+	return &buildStack{Name: current}, nil
+}
 
+func (b *Builder) setBuildStack(ctx context.Context, h *herokuSDK.Service, stack string) error {
+	_, err := h.AppUpdate(ctx, b.buildApp(), herokuSDK.AppUpdateOpts{BuildStack: &stack})
+	return err
+}
+
+func (b *Builder) createHerokuBuild(ctx context.Context, h *herokuSDK.Service, sourceURL, checksum, sourceVersion string, w io.Writer) (*herokuSDK.Build, error) {
 	buildOpts := herokuSDK.BuildCreateOpts{}
 	buildOpts.SourceBlob.URL = &sourceURL
+	if checksum != "" {
+		buildOpts.SourceBlob.Checksum = &checksum
+	}
 	buildOpts.SourceBlob.Version = &sourceVersion
-	build, err := h.BuildCreate(ctx, b.config.App, buildOpts)
+	for _, bp := range b.config.Buildpacks {
+		buildOpts.Buildpacks = append(buildOpts.Buildpacks, buildpackOpt(bp))
+	}
+	build, err := h.BuildCreate(ctx, b.buildApp(), buildOpts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	resp, err := http.Get(build.OutputStreamURL)
-	if err != nil {
-		return "", err
+	tail := &tailWriter{max: buildErrorLines}
+	if err := streamOutput(ctx, build.OutputStreamURL, io.MultiWriter(w, tail)); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		return "", err
+	// The output stream can close before Heroku has recorded the outcome,
+	// so wait for the build to leave "pending".
+	for build.Status == "pending" {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(buildPollInterval):
+		}
+
+		build, err = h.BuildInfo(ctx, b.buildApp(), build.ID)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	build, err = h.BuildInfo(ctx, b.config.App, build.ID)
-	if err != nil {
-		return "", err
+	if build.Status != "succeeded" || build.Slug == nil {
+		return nil, &BuildFailedError{
+			App:     b.buildApp(),
+			BuildID: build.ID,
+			Status:  build.Status,
+			Output:  tail.Lines(),
+		}
 	}
 
-	return build.Slug.ID, nil
+	return build, nil
 }
 
-func (b *Builder) createHerokuSlug(ctx context.Context, h *herokuSDK.Service, log hclog.Logger, tf *os.File) (string, error) {
-	processTypesRaw, err := procfile.NewProcfileFromPath(b.config.Source)
-	if err != nil {
-		return "", err
+// buildpackOpt describes a configured buildpack to the build API, which
+// takes registry names such as "heroku/nodejs" separately from URLs.
+func buildpackOpt(bp string) *struct {
+	Name *string `json:"name,omitempty" url:"name,omitempty,key"`
+	URL  *string `json:"url,omitempty" url:"url,omitempty,key"`
+} {
+	opt := &struct {
+		Name *string `json:"name,omitempty" url:"name,omitempty,key"`
+		URL  *string `json:"url,omitempty" url:"url,omitempty,key"`
+	}{}
+	if strings.Contains(bp, "://") {
+		opt.URL = String(bp)
+	} else {
+		opt.Name = String(bp)
 	}
+	return opt
+}
 
-	processTypes := map[string]string{}
-	for k, v := range processTypesRaw {
-		processTypes[k], _ = v.(string)
+// buildpacksMatch reports whether build ran the configured buildpacks, in
+// order. Any build matches when none are configured.
+func (b *Builder) buildpacksMatch(build *herokuSDK.Build) bool {
+	if len(b.config.Buildpacks) == 0 {
+		return true
 	}
-
-	o := herokuSDK.SlugCreateOpts{
-		BuildpackProvidedDescription: String("waypoint-plugin-heroku"),
-		ProcessTypes:                 processTypes,
+	if len(build.Buildpacks) != len(b.config.Buildpacks) {
+		return false
 	}
-	slug, err := h.SlugCreate(ctx, b.config.App, o)
-	if err != nil {
-		return "", err
+	for i, bp := range b.config.Buildpacks {
+		if build.Buildpacks[i].URL != bp && build.Buildpacks[i].Name != bp {
+			return false
+		}
 	}
-	log.Info(
-		"Slug created",
-		"source", slug,
-	)
+	return true
+}
 
-	if _, err := tf.Seek(0, 0); err != nil {
-		return "", err
+// persistBuildpacks replaces the app's buildpacks with the configured ones
+// if PersistBuildpacks is set.
+func (b *Builder) persistBuildpacks(ctx context.Context, h *herokuSDK.Service, sg terminal.StepGroup) error {
+	if !b.config.PersistBuildpacks || len(b.config.Buildpacks) == 0 {
+		return nil
 	}
-	req, err := http.NewRequest("PUT", slug.Blob.URL, tf)
-	if err != nil {
-		return "", err
+
+	step := sg.Add("Saving buildpacks to app...")
+	var o herokuSDK.BuildpackInstallationUpdateOpts
+	for _, bp := range b.config.Buildpacks {
+		o.Updates = append(o.Updates, struct {
+			Buildpack string `json:"buildpack" url:"buildpack,key"`
+		}{Buildpack: bp})
 	}
-	stat, err := tf.Stat()
-	if err != nil {
-		return "", err
+	if _, err := h.BuildpackInstallationUpdate(ctx, b.buildApp(), o); err != nil {
+		step.Abort()
+		return err
 	}
-	req.ContentLength = stat.Size()
+	step.Done()
+	return nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// cacheLookback is how many recent builds findCachedBuild considers.
+const cacheLookback = 50
+
+// findCachedBuild returns the most recent successful build on stack, with
+// the configured buildpacks, whose source archive had the same checksum.
+// Sources without a checksum, such as remote URLs, match builds without one
+// on source version instead; a local archive may hold uncommitted changes,
+// so it never matches on version alone. Either way the env hash in the
+// version must match.
+func (b *Builder) findCachedBuild(ctx context.Context, h *herokuSDK.Service, checksum, version, stack string) (*herokuSDK.Build, error) {
+	builds, err := h.BuildList(ctx, b.buildApp(), &herokuSDK.ListRange{
+		Field:      "created_at",
+		Max:        cacheLookback,
+		Descending: true,
+	})
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	for i := range builds {
+		build := &builds[i]
+		if build.Status != "succeeded" || build.Slug == nil || build.Stack != stack || !b.buildpacksMatch(build) {
+			continue
+		}
+		_, buildEnv := splitEnvVersion(stringValue(build.SourceBlob.Version))
+		if _, env := splitEnvVersion(version); buildEnv != env {
+			continue
+		}
+		if c := build.SourceBlob.Checksum; c != nil {
+			if *c == checksum {
+				return build, nil
+			}
+		} else if v := build.SourceBlob.Version; checksum == "" && v != nil && version != "" && *v == version {
+			return build, nil
+		}
 	}
-	defer resp.Body.Close()
+	return nil, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
+// slugPrefix is the directory Heroku expects slug contents under; it is
+// unpacked as /app on dynos.
+const slugPrefix = "./app"
+
+// maxSlugSize is Heroku's limit on compressed slug size.
+const maxSlugSize = 500 << 20
+
+func readProcessTypes(source string) (map[string]string, error) {
+	processTypesRaw, err := procfile.NewProcfileFromPath(source)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	log.Info("Slug upload complete", "code", resp.StatusCode, "body", string(body))
+	processTypes := map[string]string{}
+	for k, v := range processTypesRaw {
+		processTypes[k], _ = v.(string)
+	}
+	return processTypes, nil
+}
 
-	return slug.ID, nil
+// validateProcessTypes checks that the files referenced by each process
+// command exist in source. Slugs skip the buildpack, so nothing else will
+// create them before the command runs from /app.
+func validateProcessTypes(source string, processTypes map[string]string) error {
+	var problems []string
+	for name, command := range processTypes {
+		for _, arg := range strings.Fields(command) {
+			rel, ok := slugPath(arg)
+			if !ok {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(source, filepath.FromSlash(rel))); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s not found in %s", name, arg, source))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("Procfile references missing files:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
 }
 
-// Tar takes a source and variable writers and walks 'source' writing each file
-// found to the tar writer; the purpose for accepting multiple writers is to allow
-// for multiple outputs (for example a file, or md5 hash)
-func Tar(src string, writers ...io.Writer) error {
-	// ensure the src actually exists before trying to tar it
-	if _, err := os.Stat(src); err != nil {
-		return fmt.Errorf("Unable to tar files - %v", err.Error())
+// slugPath returns the path relative to /app of a Procfile argument that
+// names a file in the slug, such as "bin/web", "./server" or "/app/run.sh".
+// Flags, variables, URLs and paths elsewhere on the dyno are ignored.
+func slugPath(arg string) (string, bool) {
+	if strings.HasPrefix(arg, "-") || strings.ContainsAny(arg, "$=*") || strings.Contains(arg, "://") {
+		return "", false
+	}
+	if strings.HasPrefix(arg, "/") {
+		if !strings.HasPrefix(arg, "/app/") {
+			return "", false
+		}
+		return strings.TrimPrefix(arg, "/app/"), true
+	}
+	if !strings.Contains(arg, "/") {
+		return "", false
 	}
+	return path.Clean(arg), true
+}
 
-	mw := io.MultiWriter(writers...)
+// buildPollInterval is how often BuildInfo is polled while a build is
+// pending, and buildErrorLines how much output a BuildFailedError keeps.
+var (
+	buildPollInterval = 2 * time.Second
+	buildErrorLines   = 20
+)
 
-	gzw := gzip.NewWriter(mw)
-	defer gzw.Close()
+// BuildFailedError is returned when Heroku finishes a build without a slug.
+type BuildFailedError struct {
+	App     string
+	BuildID string
+	Status  string
+	// Output holds the last lines of the build output.
+	Output []string
+}
 
-	tw := tar.NewWriter(gzw)
-	defer tw.Close()
+func (e *BuildFailedError) Error() string {
+	msg := fmt.Sprintf("build %s on app %s %s", e.BuildID, e.App, e.Status)
+	if len(e.Output) > 0 {
+		msg += ":\n" + strings.Join(e.Output, "\n")
+	}
+	return msg
+}
 
-	// walk path
-	return filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
+// streamRetries and streamRetryInterval bound how long streamOutput waits
+// for an output stream that doesn't exist yet, as release phase streams
+// often 404 at first.
+var (
+	streamRetries       = 10
+	streamRetryInterval = time.Second
+)
 
-		// return on any error
+// streamOutput copies a build or release output stream to w until Heroku
+// closes it.
+func streamOutput(ctx context.Context, url string, w io.Writer) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 		if err != nil {
 			return err
 		}
-
-		// return on non-regular files (thanks to [kumo](https://medium.com/@komuw/just-like-you-did-fbdd7df829d3) for this suggested update)
-		if !fi.Mode().IsRegular() {
-			return nil
-		}
-
-		// create a new dir/file header
-		header, err := tar.FileInfoHeader(fi, fi.Name())
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return err
 		}
 
-		// update the name to correctly reflect the desired destination when untaring
-		header.Name = strings.TrimPrefix(strings.Replace(file, src, "", -1), string(filepath.Separator))
-
-		// write the header
-		if err := tw.WriteHeader(header); err != nil {
-			return err
+		if resp.StatusCode == http.StatusNotFound && attempt < streamRetries {
+			resp.Body.Close()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(streamRetryInterval):
+			}
+			continue
 		}
-
-		// open files for taring
-		f, err := os.Open(file)
-		if err != nil {
-			return err
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			resp.Body.Close()
+			return fmt.Errorf("reading output stream: %s", resp.Status)
 		}
 
-		// copy file data into tar writer
-		if _, err := io.Copy(tw, f); err != nil {
-			return err
+		_, err = io.Copy(w, resp.Body)
+		resp.Body.Close()
+		return err
+	}
+}
+
+// tailWriter keeps the last max lines written to it.
+type tailWriter struct {
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
 		}
+		t.add(string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) add(line string) {
+	t.lines = append(t.lines, strings.TrimRight(line, "\r"))
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
 
-		// manually close here after each file operation; defering would cause each file close
-		// to wait until all operations have completed.
-		f.Close()
+// Lines returns the buffered lines, including any unterminated last line.
+func (t *tailWriter) Lines() []string {
+	if len(t.partial) > 0 {
+		t.add(string(t.partial))
+		t.partial = nil
+	}
+	return t.lines
+}
 
-		return nil
-	})
+func (b *Builder) createHerokuSlug(ctx context.Context, h *herokuSDK.Service, log hclog.Logger, archive *localArchive, processTypes map[string]string) (*herokuSDK.Slug, error) {
+	o := herokuSDK.SlugCreateOpts{
+		BuildpackProvidedDescription: String("waypoint-plugin-heroku"),
+		ProcessTypes:                 processTypes,
+		Checksum:                     &archive.Checksum,
+	}
+	if commit := gitCommit(b.config.Source); commit != "" {
+		o.Commit = &commit
+	}
+	if b.config.Stack != "" {
+		o.Stack = &b.config.Stack
+	}
+	slug, err := h.SlugCreate(ctx, b.buildApp(), o)
+	if err != nil {
+		return nil, err
+	}
+	log.Info(
+		"Slug created",
+		"source", slug,
+	)
+
+	if err := heroku.PutBlob(ctx, slug.Blob.URL, archive.Size, archive.Open); err != nil {
+		return nil, err
+	}
+	log.Info("Slug upload complete")
+
+	slug, err = h.SlugInfo(ctx, b.buildApp(), slug.ID)
+	if err != nil {
+		return nil, err
+	}
+	if slug.Checksum == nil || *slug.Checksum != archive.Checksum {
+		return nil, fmt.Errorf("slug %s checksum mismatch: uploaded %s, Heroku reports %s", slug.ID, archive.Checksum, stringValue(slug.Checksum))
+	}
+
+	return slug, nil
 }
 
 func String(s string) *string {
 	return &s
 }
 
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 var (
-	_ component.Builder      = (*Builder)(nil)
-	_ component.Configurable = (*Builder)(nil)
+	_ component.Builder            = (*Builder)(nil)
+	_ component.Configurable       = (*Builder)(nil)
+	_ component.ConfigurableNotify = (*Builder)(nil)
 )
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSlugPath(t *testing.T) {
+	cases := map[string]string{
+		"bin/web":        "bin/web",
+		"./server":       "server",
+		"/app/run.sh":    "run.sh",
+		"node":           "",
+		"/usr/bin/env":   "",
+		"--config=a/b":   "",
+		"$HOME/bin/x":    "",
+		"https://a.b/c":  "",
+		"lib/**/spec.rb": "",
+	}
+	for arg, want := range cases {
+		got, ok := slugPath(arg)
+		if ok != (want != "") || got != want {
+			t.Errorf("slugPath(%q) = %q, %v; want %q", arg, got, ok, want)
+		}
+	}
+}
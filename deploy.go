@@ -3,17 +3,31 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"strings"
+	"time"
 
 	"github.com/fanatic/waypoint-plugin-heroku/heroku"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/waypoint-plugin-sdk/component"
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
 	herokuSDK "github.com/heroku/heroku-go/v5"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type DeployConfig struct {
 	Pipeline string `hcl:"pipeline,optional"`
 	App      string `hcl:"app,optional"`
+	APIKey   string `hcl:"api_key,optional"`
+
+	// ProcessTypes limits a container release to these process types,
+	// instead of every one the registry pushed.
+	ProcessTypes []string `hcl:"process_types,optional"`
+
+	// OnDestroy is what destroying a deployment does: "rollback" to the
+	// previous release (the default) or "scale_down" to zero dynos on a
+	// shared app, or "delete" an app made for a single deployment.
+	OnDestroy string `hcl:"on_destroy,optional"`
 }
 
 func (d *Deployment) URL() string { return d.Url }
@@ -46,7 +60,9 @@ func (p *Platform) deploy(
 	log hclog.Logger,
 	artifact *Artifact,
 	//slug *builder.Slug,
-) (*Deployment, error) {
+) (deployment *Deployment, err error) {
+	defer recoverPanic(log, &err)
+
 	log.Info(
 		"Start deploy",
 		"src", src,
@@ -54,7 +70,7 @@ func (p *Platform) deploy(
 		"artifact", artifact,
 	)
 
-	h, err := heroku.New()
+	h, err := heroku.New(p.config.APIKey)
 	if err != nil {
 		return nil, err
 	}
@@ -64,14 +80,32 @@ func (p *Platform) deploy(
 	// 	 p.createHerokuApp()
 	// }
 
+	var release *herokuSDK.Release
 	if artifact.ContainerImageDigest != "" {
-		if err := p.releaseHerokuContainer(ctx, log, h, p.config.App, artifact.ContainerImageDigest); err != nil {
+		processTypes, err := p.containerProcessTypes(artifact)
+		if err != nil {
+			return nil, err
+		}
+		step := ui.StepGroup().Add("Releasing %s to %s for %s...", artifact.ContainerImageDigest, p.config.App, strings.Join(processTypes, ", "))
+		release, err = p.releaseHerokuContainer(ctx, log, h, p.config.App, artifact.ContainerImageDigest, processTypes, step.TermOutput())
+		if err != nil {
+			step.Abort()
 			return nil, err
 		}
+		step.Update("Released v%d of %s", release.Version, p.config.App)
+		step.Done()
 	} else if artifact.SlugID != "" {
-		if err := p.releaseHerokuSlug(ctx, log, h, job, p.config.App, artifact.SlugID); err != nil {
+		if artifact.App != "" && artifact.App != p.config.App {
+			log.Info("Releasing slug from build app", "build_app", artifact.App, "app", p.config.App)
+		}
+		step := ui.StepGroup().Add("Releasing slug %s to %s...", artifact.SlugID, p.config.App)
+		release, err = p.releaseHerokuSlug(ctx, log, h, job, p.config.App, artifact, step.TermOutput())
+		if err != nil {
+			step.Abort()
 			return nil, err
 		}
+		step.Update("Released v%d of %s", release.Version, p.config.App)
+		step.Done()
 	} else {
 		return nil, fmt.Errorf("missing either container or slug artifact")
 	}
@@ -82,20 +116,62 @@ func (p *Platform) deploy(
 	}
 
 	return &Deployment{
-		Url: app.WebURL,
+		Url:                  app.WebURL,
+		App:                  app.Name,
+		AppID:                app.ID,
+		ReleaseID:            release.ID,
+		Version:              int32(release.Version),
+		SlugID:               artifact.SlugID,
+		ContainerImageDigest: artifact.ContainerImageDigest,
+		CreatedAt:            timestamppb.New(release.CreatedAt),
 	}, nil
 }
 
-func (p *Platform) releaseHerokuContainer(ctx context.Context, log hclog.Logger, h *herokuSDK.Service, app, dockerImage string) error {
+// containerProcessTypes returns the process types to release an image for:
+// those configured, which must have been pushed, or else those pushed.
+func (p *Platform) containerProcessTypes(artifact *Artifact) ([]string, error) {
+	if len(p.config.ProcessTypes) == 0 {
+		if len(artifact.ProcessTypes) == 0 {
+			return []string{"web"}, nil
+		}
+		return artifact.ProcessTypes, nil
+	}
+
+	if len(artifact.ProcessTypes) > 0 {
+		pushed := map[string]bool{}
+		for _, t := range artifact.ProcessTypes {
+			pushed[t] = true
+		}
+		for _, t := range p.config.ProcessTypes {
+			if !pushed[t] {
+				return nil, fmt.Errorf("process type %q was not pushed to the registry; pushed %s",
+					t, strings.Join(artifact.ProcessTypes, ", "))
+			}
+		}
+	}
+	return p.config.ProcessTypes, nil
+}
+
+// releaseHerokuContainer points every process type at dockerImage in a
+// single formation update, the container release flow `heroku
+// container:release` uses, then waits for the release it creates.
+func (p *Platform) releaseHerokuContainer(ctx context.Context, log hclog.Logger, h *herokuSDK.Service, app, dockerImage string, processTypes []string, w io.Writer) (*herokuSDK.Release, error) {
+	previous, err := latestRelease(ctx, h, app)
+	if err != nil {
+		return nil, err
+	}
+
 	type Update struct {
 		DockerImage string `json:"docker_image" url:"docker_image,key"`
-		Process     string `json:"process" url:"process,key"`
+		Type        string `json:"type" url:"type,key"`
 	}
 
 	opts := struct {
 		Updates []Update `json:"updates" url:"updates,key"`
 	}{}
-	opts.Updates = append(opts.Updates, Update{Process: "web", DockerImage: dockerImage})
+	for _, t := range processTypes {
+		opts.Updates = append(opts.Updates, Update{Type: t, DockerImage: dockerImage})
+	}
 	log.Info(
 		"About to update formation",
 		"app", app,
@@ -103,38 +179,168 @@ func (p *Platform) releaseHerokuContainer(ctx context.Context, log hclog.Logger,
 		"opts", opts,
 	)
 
+	// Only the docker-releases variant of the API accepts images.
+	hd, err := heroku.New(p.config.APIKey, heroku.WithHeader("Accept", heroku.DockerReleasesAccept))
+	if err != nil {
+		return nil, err
+	}
 	var formation herokuSDK.FormationBatchUpdateResult
-	if err := h.Patch(ctx, &formation, fmt.Sprintf("/apps/%v/formation", app), opts); err != nil {
-		return err
+	if err := hd.Patch(ctx, &formation, fmt.Sprintf("/apps/%v/formation", app), opts); err != nil {
+		return nil, err
 	}
 
 	log.Info(
 		"Formation updated",
 		"formation", formation,
 	)
-	return nil
+
+	release, err := containerRelease(ctx, h, app, dockerImage, previous)
+	if err != nil {
+		return nil, err
+	}
+	log.Info(
+		"Release created",
+		"release", release,
+	)
+	return waitForRelease(ctx, h, app, release, w)
+}
+
+// containerRelease finds the release a formation update of dockerImage
+// created after previous. Heroku describes these as "Deployed web
+// (<image ID>)", which tells them apart from releases made at the same
+// time, such as config var changes.
+func containerRelease(ctx context.Context, h *herokuSDK.Service, app, dockerImage string, previous *herokuSDK.Release) (*herokuSDK.Release, error) {
+	id := strings.TrimPrefix(dockerImage, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	releases, err := recentReleases(ctx, h, app)
+	if err != nil {
+		return nil, err
+	}
+	// Releases are newest first; the first matching one after previous is
+	// ours.
+	var release *herokuSDK.Release
+	for i := range releases {
+		if previous != nil && releases[i].Version <= previous.Version {
+			break
+		}
+		if strings.Contains(releases[i].Description, id) {
+			release = &releases[i]
+		}
+	}
+	if release == nil {
+		return nil, fmt.Errorf("updating the formation of app %s did not create a release of %s", app, dockerImage)
+	}
+	return release, nil
+}
+
+// latestRelease returns the app's newest release, or nil if it has none.
+func latestRelease(ctx context.Context, h *herokuSDK.Service, app string) (*herokuSDK.Release, error) {
+	releases, err := h.ReleaseList(ctx, app, &herokuSDK.ListRange{
+		Field:      "version",
+		Max:        1,
+		Descending: true,
+	})
+	if err != nil || len(releases) == 0 {
+		return nil, err
+	}
+	return &releases[0], nil
 }
 
-func (p *Platform) releaseHerokuSlug(ctx context.Context, log hclog.Logger, h *herokuSDK.Service, job *component.JobInfo, app, slugID string) error {
-	desc := "Deployed " + job.Id
+func (p *Platform) releaseHerokuSlug(ctx context.Context, log hclog.Logger, h *herokuSDK.Service, job *component.JobInfo, app string, artifact *Artifact, w io.Writer) (*herokuSDK.Release, error) {
+	desc := releaseDescription(job, artifact)
 	release, err := h.ReleaseCreate(ctx, app, herokuSDK.ReleaseCreateOpts{
 		Description: &desc,
-		Slug:        slugID,
+		Slug:        artifact.SlugID,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Info(
 		"Release created",
 		"release", release,
 	)
-	return nil
+	return waitForRelease(ctx, h, app, release, w)
+}
+
+// releasePollInterval is how often ReleaseInfo is polled while a release
+// is pending.
+var releasePollInterval = 2 * time.Second
+
+// waitForRelease streams the release phase output of release to w and
+// waits for it to finish, returning a *ReleaseFailedError unless it
+// succeeds.
+func waitForRelease(ctx context.Context, h *herokuSDK.Service, app string, release *herokuSDK.Release, w io.Writer) (*herokuSDK.Release, error) {
+	tail := &tailWriter{max: buildErrorLines}
+	if release.OutputStreamURL != nil {
+		if err := streamOutput(ctx, *release.OutputStreamURL, io.MultiWriter(w, tail)); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	for release.Status == "pending" {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(releasePollInterval):
+		}
+
+		release, err = h.ReleaseInfo(ctx, app, release.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if release.Status != "succeeded" {
+		return nil, &ReleaseFailedError{
+			App:     app,
+			Version: release.Version,
+			Status:  release.Status,
+			Output:  tail.Lines(),
+		}
+	}
+	return release, nil
+}
+
+// ReleaseFailedError is returned when a release, usually its release phase,
+// doesn't succeed.
+type ReleaseFailedError struct {
+	App     string
+	Version int
+	Status  string
+	// Output holds the last lines of the release phase output.
+	Output []string
+}
+
+func (e *ReleaseFailedError) Error() string {
+	msg := fmt.Sprintf("release v%d of app %s %s", e.Version, e.App, e.Status)
+	if len(e.Output) > 0 {
+		msg += ":\n" + strings.Join(e.Output, "\n")
+	}
+	return msg
+}
+
+// releaseDescription matches the "Deploy <commit>" descriptions Heroku gives
+// releases of git pushes, falling back to the job ID.
+func releaseDescription(job *component.JobInfo, artifact *Artifact) string {
+	if c := artifact.Commit; c != "" {
+		if len(c) > 8 {
+			c = c[:8]
+		}
+		return "Deploy " + c
+	}
+	return "Deployed " + job.Id
 }
 
 var (
-	_ component.Platform         = (*Platform)(nil)
-	_ component.Configurable     = (*Platform)(nil)
-	_ component.PlatformReleaser = (*Platform)(nil)
-	_ component.Deployment       = (*Deployment)(nil)
+	_ component.Platform           = (*Platform)(nil)
+	_ component.Configurable       = (*Platform)(nil)
+	_ component.ConfigurableNotify = (*Platform)(nil)
+	_ component.PlatformReleaser   = (*Platform)(nil)
+	_ component.Destroyer          = (*Platform)(nil)
+	_ component.Deployment         = (*Deployment)(nil)
 )
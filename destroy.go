@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fanatic/waypoint-plugin-heroku/heroku"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	herokuSDK "github.com/heroku/heroku-go/v5"
+)
+
+// validOnDestroy lists the values DeployConfig.OnDestroy accepts, the
+// default first.
+var validOnDestroy = []string{"rollback", "scale_down", "delete"}
+
+// DestroyFunc implements component.Destroyer
+func (p *Platform) DestroyFunc() interface{} {
+	return p.destroy
+}
+
+func (p *Platform) onDestroy() string {
+	if p.config.OnDestroy == "" {
+		return validOnDestroy[0]
+	}
+	return p.config.OnDestroy
+}
+
+// destroy undoes a deployment according to on_destroy: the app is rolled
+// back, scaled down or deleted. Apps are only changed while the deployment
+// is still their current release, so destroying an old deployment leaves
+// newer ones running.
+func (p *Platform) destroy(
+	ctx context.Context,
+	ui terminal.UI,
+	log hclog.Logger,
+	deployment *Deployment,
+) (err error) {
+	defer recoverPanic(log, &err)
+
+	app := deployment.App
+	if app == "" {
+		app = p.config.App
+	}
+	log.Info("Start destroy", "app", app, "deployment", deployment, "on_destroy", p.onDestroy())
+
+	h, err := heroku.New(p.config.APIKey)
+	if err != nil {
+		return err
+	}
+
+	sg := ui.StepGroup()
+	defer sg.Wait()
+
+	releases, err := recentReleases(ctx, h, app)
+	if err != nil {
+		if p.onDestroy() == "delete" && isNotFound(err) {
+			ui.Output("App %s was already deleted", app)
+			return nil
+		}
+		return err
+	}
+	current := currentRelease(releases)
+	if deployment.ReleaseID == "" || current == nil || current.ID != deployment.ReleaseID {
+		ui.Output("Release v%d is not the current release of %s, leaving the app unchanged", deployment.Version, app)
+		return nil
+	}
+
+	switch p.onDestroy() {
+	case "delete":
+		step := sg.Add("Deleting app %s...", app)
+		if _, err := h.AppDelete(ctx, app); err != nil {
+			step.Abort()
+			return err
+		}
+		step.Update("Deleted app %s", app)
+		step.Done()
+
+	case "rollback":
+		var previous *herokuSDK.Release
+		for i := range releases {
+			if releases[i].Version < current.Version && releases[i].Status == "succeeded" {
+				previous = &releases[i]
+				break
+			}
+		}
+		if previous == nil {
+			return fmt.Errorf("app %s has no earlier release to roll back to from v%d; use on_destroy = \"scale_down\" or \"delete\"", app, current.Version)
+		}
+
+		step := sg.Add("Rolling back %s to v%d...", app, previous.Version)
+		release, err := h.ReleaseRollback(ctx, app, herokuSDK.ReleaseRollbackOpts{Release: previous.ID})
+		if err == nil {
+			release, err = waitForRelease(ctx, h, app, release, step.TermOutput())
+		}
+		if err != nil {
+			step.Abort()
+			return err
+		}
+		step.Update("Rolled back %s to v%d as v%d", app, previous.Version, release.Version)
+		step.Done()
+
+	case "scale_down":
+		step := sg.Add("Scaling %s to zero...", app)
+		if err := scaleToZero(ctx, h, app); err != nil {
+			step.Abort()
+			return err
+		}
+		step.Update("Scaled every process of %s to zero", app)
+		step.Done()
+	}
+	return nil
+}
+
+// scaleToZero stops every dyno of app in a single formation update.
+func scaleToZero(ctx context.Context, h *herokuSDK.Service, app string) error {
+	formation, err := h.FormationList(ctx, app, nil)
+	if err != nil {
+		return err
+	}
+
+	type Update struct {
+		Quantity int    `json:"quantity" url:"quantity,key"`
+		Type     string `json:"type" url:"type,key"`
+	}
+
+	opts := struct {
+		Updates []Update `json:"updates" url:"updates,key"`
+	}{}
+	for _, f := range formation {
+		if f.Quantity > 0 {
+			opts.Updates = append(opts.Updates, Update{Type: f.Type})
+		}
+	}
+	if len(opts.Updates) == 0 {
+		return nil
+	}
+
+	var result herokuSDK.FormationBatchUpdateResult
+	return h.Patch(ctx, &result, fmt.Sprintf("/apps/%v/formation", app), opts)
+}
+
+// isNotFound reports whether err is a 404 from the API.
+func isNotFound(err error) bool {
+	var apiErr *heroku.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
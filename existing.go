@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/fanatic/waypoint-plugin-heroku/heroku"
+	herokuSDK "github.com/heroku/heroku-go/v5"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// releaseLookback is how many recent releases are searched for the current
+// one.
+const releaseLookback = 10
+
+// recentReleases returns the app's last releaseLookback releases, newest
+// first.
+func recentReleases(ctx context.Context, h *herokuSDK.Service, app string) (herokuSDK.ReleaseListResult, error) {
+	return h.ReleaseList(ctx, app, &herokuSDK.ListRange{
+		Field:      "version",
+		Max:        releaseLookback,
+		Descending: true,
+	})
+}
+
+// currentRelease returns the current release among releases, or nil.
+func currentRelease(releases herokuSDK.ReleaseListResult) *herokuSDK.Release {
+	for i := range releases {
+		if releases[i].Current {
+			return &releases[i]
+		}
+	}
+	return nil
+}
+
+// existingApp is the app whose current release `from = "existing"` uses. A
+// build app never gets releases, so it is only used when no app is
+// configured.
+func (b *Builder) existingApp() string {
+	if b.config.App != "" {
+		return b.config.App
+	}
+	return b.config.BuildApp
+}
+
+// existingArtifact returns the slug or container image of the current
+// release of existingApp, for apps built outside Waypoint such as by
+// Heroku's GitHub integration.
+func (b *Builder) existingArtifact(ctx context.Context, h *herokuSDK.Service) (*Artifact, error) {
+	app := b.existingApp()
+
+	releases, err := recentReleases(ctx, h, app)
+	if err != nil {
+		return nil, err
+	}
+	current := currentRelease(releases)
+	if current == nil {
+		return nil, fmt.Errorf("app %s has no current release", app)
+	}
+
+	if current.Slug != nil {
+		slug, err := h.SlugInfo(ctx, app, current.Slug.ID)
+		if err != nil {
+			return nil, err
+		}
+		// Slugs record the version of their build, env hash included.
+		commit, _ := splitEnvVersion(stringValue(slug.Commit))
+		return &Artifact{
+			App:       app,
+			AppID:     current.App.ID,
+			SlugID:    slug.ID,
+			Stack:     slug.Stack.Name,
+			Commit:    commit,
+			CreatedAt: timestamppb.New(slug.CreatedAt),
+		}, nil
+	}
+
+	image, processTypes, err := b.currentImage(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	if image == "" {
+		return nil, fmt.Errorf("release v%d of app %s has neither a slug nor a container image", current.Version, app)
+	}
+	return &Artifact{
+		App:                  app,
+		AppID:                current.App.ID,
+		ContainerImageDigest: image,
+		ProcessTypes:         processTypes,
+		CreatedAt:            timestamppb.New(current.CreatedAt),
+	}, nil
+}
+
+// currentImage returns the container image running the app's web process,
+// or any process if it has no web process, and the process types running
+// it. Formations only report images in the docker-releases variant of the
+// API.
+func (b *Builder) currentImage(ctx context.Context, app string) (string, []string, error) {
+	h, err := heroku.New(b.config.APIKey, heroku.WithHeader("Accept", heroku.DockerReleasesAccept))
+	if err != nil {
+		return "", nil, err
+	}
+
+	var formation []struct {
+		Type        string `json:"type"`
+		DockerImage *struct {
+			ID string `json:"id"`
+		} `json:"docker_image"`
+	}
+	if err := h.Get(ctx, &formation, fmt.Sprintf("/apps/%v/formation", app), nil, nil); err != nil {
+		return "", nil, err
+	}
+
+	image := ""
+	for _, f := range formation {
+		if f.DockerImage == nil {
+			continue
+		}
+		if image == "" || f.Type == "web" {
+			image = f.DockerImage.ID
+		}
+	}
+
+	var processTypes []string
+	for _, f := range formation {
+		if f.DockerImage != nil && f.DockerImage.ID == image {
+			processTypes = append(processTypes, f.Type)
+		}
+	}
+	sort.Strings(processTypes)
+	return image, processTypes, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// EnvGitHubToken is read for `from = "git"` builds when no github_token is
+// configured.
+const EnvGitHubToken = "GITHUB_TOKEN"
+
+// githubAPIURL is the GitHub API used to resolve `from = "git"` sources.
+var githubAPIURL = "https://api.github.com"
+
+// githubTarball resolves ref in repo ("owner/name") to a commit and returns
+// it with a codeload tarball URL Heroku can fetch without credentials.
+// Private repositories need a token, and their tarball URL expires after a
+// few minutes, which is plenty for Heroku to start the build.
+func githubTarball(ctx context.Context, repo, ref, token string) (commit, url string, err error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	resp, err := githubGet(ctx, fmt.Sprintf("/repos/%s/commits/%s", repo, ref), "application/vnd.github.sha", token)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("resolving %s@%s on GitHub: %s", repo, ref, resp.Status)
+	}
+	commit = strings.TrimSpace(string(body))
+
+	// The tarball endpoint redirects to codeload, with a temporary token
+	// in the URL for private repositories.
+	resp, err = githubGet(ctx, fmt.Sprintf("/repos/%s/tarball/%s", repo, commit), "", token)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	url = resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || url == "" {
+		return "", "", fmt.Errorf("fetching tarball URL for %s@%s from GitHub: %s", repo, commit, resp.Status)
+	}
+	return commit, url, nil
+}
+
+func githubGet(ctx context.Context, path, accept, token string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", githubAPIURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "token "+token)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return client.Do(req)
+}
@@ -0,0 +1,89 @@
+package heroku
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// FileBody lets PutBlob upload f, rewinding it for every attempt. The client
+// closes each body once sent, which must not close f before a retry.
+func FileBody(f *os.File) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		if _, err := f.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(f), nil
+	}
+}
+
+// BlobError is an upload to a presigned source or slug URL that S3 rejected,
+// for example because the URL expired.
+type BlobError struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+}
+
+func (e *BlobError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("blob upload failed: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("blob upload failed: %d %s: %s (request ID %s)", e.StatusCode, e.Code, e.Message, e.RequestID)
+}
+
+// blobClient is shared by every upload so they reuse its connections.
+var blobClient = NewBlobClient()
+
+// PutBlob uploads size bytes read from open to a presigned URL, retrying
+// transient failures, and returns a *BlobError if the upload is rejected.
+// open is called for every attempt and must return the same bytes each time.
+func PutBlob(ctx context.Context, url string, size int64, open func() (io.ReadCloser, error)) error {
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.ContentLength = size
+	req.GetBody = open
+
+	resp, err := blobClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return newBlobError(resp)
+}
+
+func newBlobError(resp *http.Response) *BlobError {
+	e := &BlobError{StatusCode: resp.StatusCode}
+
+	var body struct {
+		Code      string `xml:"Code"`
+		Message   string `xml:"Message"`
+		RequestID string `xml:"RequestId"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err == nil {
+		e.Code = body.Code
+		e.Message = body.Message
+		e.RequestID = body.RequestID
+	}
+	if e.RequestID == "" {
+		e.RequestID = resp.Header.Get("X-Amz-Request-Id")
+	}
+	return e
+}
@@ -0,0 +1,70 @@
+package heroku
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func tempBlob(t *testing.T, contents string) *os.File {
+	f, err := ioutil.TempFile("", "blob-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close()
+		os.Remove(f.Name())
+	})
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestPutBlobRetriesWithFullBody(t *testing.T) {
+	var calls int
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		got = string(body)
+	}))
+	defer srv.Close()
+
+	f := tempBlob(t, "slug contents")
+	if err := PutBlob(context.Background(), srv.URL, 13, FileBody(f)); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || got != "slug contents" {
+		t.Errorf("expected the full body on the second attempt, got %q after %d calls", got, calls)
+	}
+}
+
+func TestPutBlobRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AccessDenied</Code><Message>Request has expired</Message><RequestId>ABC123</RequestId></Error>`)
+	}))
+	defer srv.Close()
+
+	f := tempBlob(t, "slug contents")
+	err := PutBlob(context.Background(), srv.URL, 13, FileBody(f))
+
+	var blobErr *BlobError
+	if !errors.As(err, &blobErr) {
+		t.Fatalf("expected *BlobError, got %v", err)
+	}
+	if blobErr.StatusCode != 403 || blobErr.Code != "AccessDenied" || blobErr.RequestID != "ABC123" {
+		t.Errorf("unexpected error details %+v", blobErr)
+	}
+}
@@ -2,40 +2,170 @@ package heroku
 
 import (
 	"fmt"
-	"log"
-	"os/user"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"path/filepath"
+	"time"
 
 	heroku "github.com/heroku/heroku-go/v5"
 	"github.com/jdxcode/netrc"
 )
 
-func New() (*heroku.Service, error) {
-	p, err := fetchPassword()
+const (
+	// EnvAPIKey is the environment variable consulted for an API key when one
+	// isn't set explicitly in the component configuration.
+	EnvAPIKey = "HEROKU_API_KEY"
+
+	// EnvAPIURL overrides the Platform API base URL, mostly useful for
+	// pointing the plugin at a fake API in tests.
+	EnvAPIURL = "HEROKU_API_URL"
+
+	// DockerReleasesAccept selects the API variant that releases and
+	// reports the container images of formations. Pass it with WithHeader
+	// to clients used for those requests only.
+	DockerReleasesAccept = "application/vnd.heroku+json; version=3.docker-releases"
+)
+
+// DefaultUserAgent is sent with every API request unless overridden.
+var DefaultUserAgent = "waypoint-plugin-heroku " + heroku.DefaultUserAgent
+
+// Option configures the client returned by New.
+type Option func(*options)
+
+type options struct {
+	baseURL   string
+	userAgent string
+	timeout   time.Duration
+	proxy     func(*http.Request) (*url.URL, error)
+	headers   http.Header
+}
+
+// WithBaseURL sets the Platform API base URL.
+func WithBaseURL(u string) Option {
+	return func(o *options) { o.baseURL = u }
+}
+
+// WithUserAgent sets the User-Agent sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(o *options) { o.userAgent = ua }
+}
+
+// WithTimeout limits how long each attempt of an API request waits for a
+// response. Zero means no limit beyond the request context.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) { o.timeout = d }
+}
+
+// WithProxy routes requests through the given proxy instead of the one
+// configured in the environment.
+func WithProxy(u *url.URL) Option {
+	return func(o *options) { o.proxy = http.ProxyURL(u) }
+}
+
+// WithHeader adds a header to every request, replacing any default value.
+func WithHeader(key, value string) Option {
+	return func(o *options) { o.headers.Set(key, value) }
+}
+
+// New returns a Heroku API client authenticated with the first credential
+// found by APIKey. Each client gets its own transport, so clients for
+// different accounts can be used concurrently.
+func New(apiKey string, opts ...Option) (*heroku.Service, error) {
+	p, err := APIKey(apiKey)
 	if err != nil {
-		return nil, fmt.Errorf("Please login first with `heroku login`.")
+		return nil, err
+	}
+
+	o := options{
+		baseURL:   heroku.DefaultURL,
+		userAgent: DefaultUserAgent,
+		timeout:   60 * time.Second,
+		proxy:     http.ProxyFromEnvironment,
+		headers:   http.Header{},
+	}
+	if u := os.Getenv(EnvAPIURL); u != "" {
+		o.baseURL = u
+	}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	heroku.DefaultTransport.Password = p
-	heroku.DefaultTransport.AdditionalHeaders = map[string][]string{}
-	heroku.DefaultTransport.AdditionalHeaders["Accept"] = []string{"application/vnd.heroku+json; version=3.docker-releases"}
-	h := heroku.NewService(heroku.DefaultClient)
+	rt := NewRetryTransport(newTransport(o.proxy, o.timeout))
+	rt.APIErrors = true
+	t := &heroku.Transport{
+		Password:          p,
+		UserAgent:         o.userAgent,
+		AdditionalHeaders: o.headers,
+		Transport:         rt,
+	}
+	h := heroku.NewService(&http.Client{Transport: t})
+	h.URL = o.baseURL
 
 	return h, nil
 }
 
+// NewBlobClient returns an HTTP client for the presigned blob URLs of sources
+// and slugs. Uploads are retried like API calls when their body can be
+// replayed through http.Request.GetBody.
+func NewBlobClient() *http.Client {
+	return &http.Client{
+		Transport: NewRetryTransport(newTransport(http.ProxyFromEnvironment, 0)),
+	}
+}
+
+func newTransport(proxy func(*http.Request) (*url.URL, error), timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: timeout,
+	}
+}
+
+// APIKey resolves the Heroku API key to use. The explicit key from the
+// configuration wins, then HEROKU_API_KEY, then the api.heroku.com entry in
+// ~/.netrc written by `heroku login`.
+func APIKey(explicit string) (string, error) {
+	if explicit != "" {
+		return explicit, nil
+	}
+	if p := os.Getenv(EnvAPIKey); p != "" {
+		return p, nil
+	}
+
+	p, err := fetchPassword()
+	if err != nil {
+		return "", fmt.Errorf("no Heroku credentials found: set api_key, %s or run `heroku login` (%s)", EnvAPIKey, err)
+	}
+	return p, nil
+}
+
 func fetchPassword() (string, error) {
-	usr, err := user.Current()
+	// HOME, like the Heroku CLI, rather than the user database, so the
+	// netrc of the user running Waypoint is found in containers too.
+	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Fatalf("Error finding current user: %s", err.Error())
+		return "", fmt.Errorf("error finding home directory: %s", err)
 	}
-	n, err := netrc.Parse(filepath.Join(usr.HomeDir, ".netrc"))
+	n, err := netrc.Parse(filepath.Join(home, ".netrc"))
 	if err != nil {
-		log.Fatalf("Error finding current user: %s", err.Error())
+		return "", fmt.Errorf("error reading netrc: %s", err)
+	}
+	m := n.Machine("api.heroku.com")
+	if m == nil {
+		return "", fmt.Errorf("no api.heroku.com entry in netrc")
 	}
-	p := n.Machine("api.heroku.com").Get("password")
+	p := m.Get("password")
 	if p == "" {
-		return "", fmt.Errorf("No saved password found")
+		return "", fmt.Errorf("no saved password found")
 	}
 	return p, nil
 }
@@ -0,0 +1,139 @@
+package heroku
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewIsolatesCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pass, _ := r.BasicAuth()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"id":   pass,
+			"name": r.Header.Get("X-Test"),
+		})
+	}))
+	defer srv.Close()
+
+	a, err := New("key-a", WithBaseURL(srv.URL), WithHeader("X-Test", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New("key-b", WithBaseURL(srv.URL), WithHeader("X-Test", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appA, err := a.AppInfo(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appB, err := b.AppInfo(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if appA.ID != "key-a" || appA.Name != "a" {
+		t.Errorf("client a sent key %q header %q", appA.ID, appA.Name)
+	}
+	if appB.ID != "key-b" || appB.Name != "b" {
+		t.Errorf("client b sent key %q header %q", appB.ID, appB.Name)
+	}
+}
+
+func TestAPIKeyPrecedence(t *testing.T) {
+	old := os.Getenv(EnvAPIKey)
+	defer os.Setenv(EnvAPIKey, old)
+	os.Setenv(EnvAPIKey, "from-env")
+
+	if k, _ := APIKey("explicit"); k != "explicit" {
+		t.Errorf("expected explicit key, got %q", k)
+	}
+	if k, _ := APIKey(""); k != "from-env" {
+		t.Errorf("expected env key, got %q", k)
+	}
+}
+
+func TestAPIKeyNetrc(t *testing.T) {
+	oldKey, oldHome := os.Getenv(EnvAPIKey), os.Getenv("HOME")
+	defer os.Setenv(EnvAPIKey, oldKey)
+	defer os.Setenv("HOME", oldHome)
+	os.Unsetenv(EnvAPIKey)
+
+	cases := []struct {
+		name  string
+		netrc string
+		key   string
+		err   string
+	}{
+		{"heroku login", "machine api.heroku.com\n  login me@example.com\n  password from-netrc\n", "from-netrc", ""},
+		{"no netrc", "", "", "error reading netrc"},
+		{"no api.heroku.com entry", "machine git.heroku.com\n  login me@example.com\n  password from-git\n", "", "no api.heroku.com entry"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			home, err := ioutil.TempDir("", "waypoint-plugin-heroku-home")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(home)
+			os.Setenv("HOME", home)
+			if c.netrc != "" {
+				if err := ioutil.WriteFile(filepath.Join(home, ".netrc"), []byte(c.netrc), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			k, err := APIKey("")
+			if c.err == "" {
+				if err != nil || k != c.key {
+					t.Errorf("expected key %q, got %q, %v", c.key, k, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) || !strings.Contains(err.Error(), "no Heroku credentials found") {
+				t.Errorf("expected an error mentioning %q, got %q, %v", c.err, k, err)
+			}
+		})
+	}
+}
+
+func TestNewAcceptHeader(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{"name": r.Header.Get("Accept")})
+	}))
+	defer srv.Close()
+
+	h, err := New("key", WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := h.AppInfo(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Name == DockerReleasesAccept {
+		t.Errorf("expected the default API variant, got %q", app.Name)
+	}
+
+	h, err = New("key", WithBaseURL(srv.URL), WithHeader("Accept", DockerReleasesAccept))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err = h.AppInfo(context.Background(), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Name != DockerReleasesAccept {
+		t.Errorf("expected the docker-releases variant, got %q", app.Name)
+	}
+}
@@ -0,0 +1,738 @@
+// Package herokutest provides an in-memory fake of the parts of the Heroku
+// Platform API used by the plugin, for end-to-end tests.
+package herokutest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// App is the fake's record of a Heroku app.
+type App struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	WebURL     string `json:"web_url"`
+	Stack      Named  `json:"stack"`
+	BuildStack Named  `json:"build_stack"`
+}
+
+// Named is an id/name reference embedded in API resources.
+type Named struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Ref is an id reference embedded in API resources.
+type Ref struct {
+	ID string `json:"id"`
+}
+
+// SourceBlob describes where a build's source came from.
+type SourceBlob struct {
+	Checksum *string `json:"checksum"`
+	URL      string  `json:"url"`
+	Version  *string `json:"version"`
+}
+
+// Build is the fake's record of a build.
+type Build struct {
+	ID              string      `json:"id"`
+	App             Ref         `json:"app"`
+	Status          string      `json:"status"`
+	OutputStreamURL string      `json:"output_stream_url"`
+	SourceBlob      SourceBlob  `json:"source_blob"`
+	Buildpacks      []Buildpack `json:"buildpacks"`
+	Slug            *Ref        `json:"slug"`
+	Release         *Ref        `json:"release"`
+	Stack           string      `json:"stack"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// Buildpack is a buildpack given to a build by URL or registry name.
+type Buildpack struct {
+	Name string `json:"name,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Blob is the presigned upload target of a slug.
+type Blob struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// Slug is the fake's record of a slug.
+type Slug struct {
+	ID                           string            `json:"id"`
+	Blob                         Blob              `json:"blob"`
+	BuildpackProvidedDescription *string           `json:"buildpack_provided_description"`
+	Checksum                     *string           `json:"checksum"`
+	Commit                       *string           `json:"commit"`
+	ProcessTypes                 map[string]string `json:"process_types"`
+	Size                         *int              `json:"size"`
+	Stack                        Named             `json:"stack"`
+	CreatedAt                    time.Time         `json:"created_at"`
+	UpdatedAt                    time.Time         `json:"updated_at"`
+}
+
+// Release is the fake's record of a release.
+type Release struct {
+	ID              string    `json:"id"`
+	App             Named     `json:"app"`
+	Version         int       `json:"version"`
+	Status          string    `json:"status"`
+	Description     string    `json:"description"`
+	Current         bool      `json:"current"`
+	Slug            *Ref      `json:"slug"`
+	OutputStreamURL *string   `json:"output_stream_url"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// FormationUpdate is a single entry of a formation batch update.
+type FormationUpdate struct {
+	Type        string `json:"type"`
+	Process     string `json:"process"`
+	DockerImage string `json:"docker_image"`
+	Quantity    *int   `json:"quantity"`
+	Size        string `json:"size"`
+}
+
+// Server is a fake Heroku Platform API. Tests configure it by setting the
+// exported fields before driving the plugin through it, and inspect the
+// recorded state afterwards.
+type Server struct {
+	*httptest.Server
+
+	// BuildStatus is the terminal status reported for new builds,
+	// "succeeded" unless set.
+	BuildStatus string
+	// BuildOutput is streamed from every build's output_stream_url.
+	BuildOutput string
+	// BuildPolls is the number of times a new build is reported as
+	// pending before it reaches BuildStatus.
+	BuildPolls int
+	// RejectUploads makes blob uploads fail like an expired presigned URL.
+	RejectUploads bool
+	// DefaultStack is the stack reported as the default for new apps,
+	// "heroku-24" unless set.
+	DefaultStack string
+
+	// ReleaseOutput, when set, gives new releases a release phase that
+	// streams it from their output_stream_url. They are reported as pending
+	// ReleasePolls times before reaching ReleaseStatus, "succeeded" unless
+	// set. Releases without a release phase succeed immediately.
+	ReleaseOutput string
+	ReleasePolls  int
+	ReleaseStatus string
+	// StreamMisses is the number of times each output stream responds 404,
+	// as if it didn't exist yet, before streaming its output.
+	StreamMisses int
+	// ConcurrentReleases is the number of unrelated releases, like those
+	// of config var changes, made right after each container release.
+	ConcurrentReleases int
+
+	mu         sync.Mutex
+	seq        int
+	apps       map[string]*App
+	builds     map[string]*Build
+	pending    map[string]int
+	misses     map[string]int
+	slugs      map[string]*Slug
+	releases   map[string][]*Release
+	formations map[string][]FormationUpdate
+	buildpacks map[string][]string
+	configVars map[string]map[string]string
+	blobs      map[string][]byte
+	requests   []string
+}
+
+// NewServer starts a fake API. Callers must Close it.
+func NewServer() *Server {
+	s := &Server{
+		apps:       map[string]*App{},
+		builds:     map[string]*Build{},
+		pending:    map[string]int{},
+		misses:     map[string]int{},
+		slugs:      map[string]*Slug{},
+		releases:   map[string][]*Release{},
+		formations: map[string][]FormationUpdate{},
+		buildpacks: map[string][]string{},
+		configVars: map[string]map[string]string{},
+		blobs:      map[string][]byte{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddApp registers an app on the fake.
+func (s *Server) AddApp(name string) *App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := &App{
+		ID:         s.nextID(),
+		Name:       name,
+		WebURL:     fmt.Sprintf("https://%s.herokuapp.com/", name),
+		Stack:      Named{ID: "stack-heroku-20", Name: "heroku-20"},
+		BuildStack: Named{ID: "stack-heroku-20", Name: "heroku-20"},
+	}
+	s.apps[name] = app
+	return app
+}
+
+// App returns the current state of an app, or nil if unknown.
+func (s *Server) App(name string) *App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.apps[name]
+}
+
+// Builds returns every build created on the fake.
+func (s *Server) Builds() []*Build {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedBuilds(false)
+}
+
+// sortedBuilds returns builds in creation order; IDs are sequential.
+func (s *Server) sortedBuilds(descending bool) []*Build {
+	var out []*Build
+	for _, b := range s.builds {
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return (out[i].ID < out[j].ID) != descending
+	})
+	return out
+}
+
+// Slug returns a slug by ID, or nil if unknown.
+func (s *Server) Slug(id string) *Slug {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.slugs[id]
+}
+
+// Releases returns the releases of an app, oldest first.
+func (s *Server) Releases(app string) []*Release {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Release(nil), s.releases[app]...)
+}
+
+// Formation returns the formation updates applied to an app.
+func (s *Server) Formation(app string) []FormationUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]FormationUpdate(nil), s.formations[app]...)
+}
+
+// Buildpacks returns the buildpacks installed on an app.
+func (s *Server) Buildpacks(app string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.buildpacks[app]...)
+}
+
+// ConfigVars returns the config vars set on an app.
+func (s *Server) ConfigVars(app string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vars := map[string]string{}
+	for k, v := range s.configVars[app] {
+		vars[k] = v
+	}
+	return vars
+}
+
+// Blob returns the bytes uploaded to a presigned blob URL.
+func (s *Server) Blob(url string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[strings.TrimPrefix(url, s.URL)]
+}
+
+// Requests returns "METHOD /path" for every request served so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) nextID() string {
+	s.seq++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", s.seq)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "blobs" && len(parts) == 2:
+		s.serveBlob(w, r)
+	case parts[0] == "streams" && len(parts) == 2:
+		if s.misses[parts[1]] < s.StreamMisses {
+			s.misses[parts[1]]++
+			writeError(w, http.StatusNotFound, "not_found", "Not found.")
+			return
+		}
+		if _, ok := s.builds[parts[1]]; ok {
+			fmt.Fprint(w, s.BuildOutput)
+		} else {
+			fmt.Fprint(w, s.ReleaseOutput)
+		}
+	case parts[0] == "stacks" && len(parts) == 1 && r.Method == "GET":
+		def := s.DefaultStack
+		if def == "" {
+			def = "heroku-24"
+		}
+		stacks := []map[string]interface{}{}
+		for _, name := range []string{"heroku-20", "heroku-22", "heroku-24"} {
+			stacks = append(stacks, map[string]interface{}{"id": "stack-" + name, "name": name, "default": name == def})
+		}
+		writeJSON(w, http.StatusOK, stacks)
+	case parts[0] == "sources" && len(parts) == 1 && r.Method == "POST":
+		id := s.nextID()
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"source_blob": map[string]string{
+				"get_url": s.URL + "/blobs/" + id,
+				"put_url": s.URL + "/blobs/" + id,
+			},
+		})
+	case parts[0] == "apps" && len(parts) >= 2:
+		app, ok := s.apps[parts[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Couldn't find that app.")
+			return
+		}
+		s.serveApp(w, r, app, parts[2:])
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Not found.")
+	}
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT":
+		if s.RejectUploads {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>AccessDenied</Code><Message>Request has expired</Message><RequestId>FAKE0REQUEST0ID</RequestId></Error>`)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.blobs[r.URL.Path] = body
+	case "GET":
+		body, ok := s.blobs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) serveApp(w http.ResponseWriter, r *http.Request, app *App, parts []string) {
+	route := r.Method + " " + strings.Join(parts, "/")
+	if len(parts) == 2 {
+		route = r.Method + " " + parts[0] + "/:id"
+	}
+
+	switch route {
+	case "GET ":
+		writeJSON(w, http.StatusOK, app)
+	case "PATCH ":
+		var opts struct {
+			BuildStack *string `json:"build_stack"`
+		}
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		if opts.BuildStack != nil {
+			app.BuildStack = Named{ID: "stack-" + *opts.BuildStack, Name: *opts.BuildStack}
+		}
+		writeJSON(w, http.StatusOK, app)
+	case "DELETE ":
+		delete(s.apps, app.Name)
+		writeJSON(w, http.StatusOK, app)
+
+	case "POST builds":
+		var opts struct {
+			SourceBlob SourceBlob  `json:"source_blob"`
+			Buildpacks []Buildpack `json:"buildpacks"`
+		}
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		b := &Build{
+			ID:         s.nextID(),
+			App:        Ref{ID: app.ID},
+			Status:     "pending",
+			SourceBlob: opts.SourceBlob,
+			Buildpacks: opts.Buildpacks,
+			Stack:      app.BuildStack.Name,
+			CreatedAt:  time.Now().UTC(),
+		}
+		b.OutputStreamURL = s.URL + "/streams/" + b.ID
+		s.builds[b.ID] = b
+		s.pending[b.ID] = s.BuildPolls
+		writeJSON(w, http.StatusCreated, b)
+	case "GET builds":
+		builds := []*Build{}
+		for _, b := range s.sortedBuilds(descending(r)) {
+			if b.App.ID == app.ID {
+				builds = append(builds, b)
+			}
+		}
+		writeJSON(w, http.StatusOK, builds)
+	case "GET builds/:id":
+		b, ok := s.builds[parts[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Couldn't find that build.")
+			return
+		}
+		if b.Status == "pending" {
+			if s.pending[b.ID] > 0 {
+				s.pending[b.ID]--
+			} else {
+				s.finishBuild(app, b)
+			}
+		}
+		writeJSON(w, http.StatusOK, b)
+
+	case "POST slugs":
+		var opts struct {
+			Checksum     *string           `json:"checksum"`
+			Commit       *string           `json:"commit"`
+			ProcessTypes map[string]string `json:"process_types"`
+			Description  *string           `json:"buildpack_provided_description"`
+			Stack        *string           `json:"stack"`
+		}
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		slug := s.newSlug(app)
+		slug.Checksum = opts.Checksum
+		slug.Commit = opts.Commit
+		slug.ProcessTypes = opts.ProcessTypes
+		slug.BuildpackProvidedDescription = opts.Description
+		if opts.Stack != nil {
+			slug.Stack = Named{ID: "stack-" + *opts.Stack, Name: *opts.Stack}
+		}
+		writeJSON(w, http.StatusCreated, slug)
+	case "GET slugs/:id":
+		slug, ok := s.slugs[parts[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Couldn't find that slug.")
+			return
+		}
+		writeJSON(w, http.StatusOK, slug)
+
+	case "POST releases":
+		var opts struct {
+			Slug        string  `json:"slug"`
+			Release     string  `json:"release"`
+			Description *string `json:"description"`
+		}
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		if opts.Release != "" {
+			s.rollback(w, app, opts.Release)
+			return
+		}
+		if _, ok := s.slugs[opts.Slug]; !ok {
+			writeError(w, http.StatusNotFound, "not_found", "Couldn't find that slug.")
+			return
+		}
+		rel := s.newRelease(app, &Ref{ID: opts.Slug})
+		if opts.Description != nil {
+			rel.Description = *opts.Description
+		}
+		writeJSON(w, http.StatusCreated, rel)
+	case "GET releases":
+		releases := append([]*Release{}, s.releases[app.Name]...)
+		if descending(r) {
+			for i, j := 0, len(releases)-1; i < j; i, j = i+1, j-1 {
+				releases[i], releases[j] = releases[j], releases[i]
+			}
+		}
+		if max := rangeMax(r); max > 0 && max < len(releases) {
+			releases = releases[:max]
+		}
+		writeJSON(w, http.StatusOK, releases)
+	case "GET releases/:id":
+		for _, rel := range s.releases[app.Name] {
+			if rel.ID == parts[1] || fmt.Sprint(rel.Version) == parts[1] {
+				if rel.Status == "pending" {
+					if s.pending[rel.ID] > 0 {
+						s.pending[rel.ID]--
+					} else {
+						s.finishRelease(app, rel)
+					}
+				}
+				writeJSON(w, http.StatusOK, rel)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "not_found", "Couldn't find that release.")
+
+	case "GET config-vars":
+		writeJSON(w, http.StatusOK, s.configVarsOf(app))
+	case "PATCH config-vars":
+		var opts map[string]*string
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		vars := s.configVarsOf(app)
+		for k, v := range opts {
+			if v == nil {
+				delete(vars, k)
+			} else {
+				vars[k] = *v
+			}
+		}
+		writeJSON(w, http.StatusOK, vars)
+
+	case "PUT buildpack-installations":
+		var opts struct {
+			Updates []struct {
+				Buildpack string `json:"buildpack"`
+			} `json:"updates"`
+		}
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		installed := []map[string]interface{}{}
+		s.buildpacks[app.Name] = nil
+		for i, u := range opts.Updates {
+			s.buildpacks[app.Name] = append(s.buildpacks[app.Name], u.Buildpack)
+			installed = append(installed, map[string]interface{}{
+				"buildpack": map[string]string{"name": u.Buildpack, "url": u.Buildpack},
+				"ordinal":   i,
+			})
+		}
+		writeJSON(w, http.StatusOK, installed)
+
+	case "GET formation":
+		// The latest image and quantity of each process, with images
+		// only reported by the docker-releases variant. Processes start
+		// with one dyno.
+		images := map[string]string{}
+		quantities := map[string]int{}
+		var types []string
+		for _, u := range s.formations[app.Name] {
+			t := u.Type
+			if t == "" {
+				t = u.Process
+			}
+			if _, ok := quantities[t]; !ok {
+				types = append(types, t)
+				quantities[t] = 1
+			}
+			if u.DockerImage != "" {
+				images[t] = u.DockerImage
+			}
+			if u.Quantity != nil {
+				quantities[t] = *u.Quantity
+			}
+		}
+		formation := []map[string]interface{}{}
+		for _, t := range types {
+			f := map[string]interface{}{"type": t, "quantity": quantities[t]}
+			if dockerReleases(r) {
+				f["docker_image"] = map[string]string{"id": images[t]}
+			}
+			formation = append(formation, f)
+		}
+		writeJSON(w, http.StatusOK, formation)
+	case "PATCH formation":
+		var opts struct {
+			Updates []FormationUpdate `json:"updates"`
+		}
+		if !readJSON(w, r, &opts) {
+			return
+		}
+		for _, u := range opts.Updates {
+			if u.DockerImage != "" && !dockerReleases(r) {
+				writeError(w, http.StatusUnprocessableEntity, "invalid_params", "docker_image requires the docker-releases variant.")
+				return
+			}
+		}
+		s.formations[app.Name] = append(s.formations[app.Name], opts.Updates...)
+		// Like Heroku, releasing new images creates a release.
+		var deployed []string
+		for _, u := range opts.Updates {
+			if u.DockerImage != "" {
+				id := strings.TrimPrefix(u.DockerImage, "sha256:")
+				if len(id) > 12 {
+					id = id[:12]
+				}
+				deployed = append(deployed, fmt.Sprintf("%s (%s)", u.Type, id))
+			}
+		}
+		if len(deployed) > 0 {
+			rel := s.newRelease(app, nil)
+			rel.Description = "Deployed " + strings.Join(deployed, ", ")
+			for i := 0; i < s.ConcurrentReleases; i++ {
+				s.newRelease(app, nil).Description = "Set FEATURE_FLAG config vars"
+			}
+		}
+		writeJSON(w, http.StatusOK, opts.Updates)
+
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Not found.")
+	}
+}
+
+// rollback creates a release of the slug of the release with id, like
+// `heroku rollback`.
+func (s *Server) rollback(w http.ResponseWriter, app *App, id string) {
+	for _, target := range s.releases[app.Name] {
+		if target.ID == id {
+			rel := s.newRelease(app, target.Slug)
+			rel.Description = fmt.Sprintf("Rollback to v%d", target.Version)
+			writeJSON(w, http.StatusCreated, rel)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "not_found", "Couldn't find that release.")
+}
+
+func (s *Server) configVarsOf(app *App) map[string]string {
+	if s.configVars[app.Name] == nil {
+		s.configVars[app.Name] = map[string]string{}
+	}
+	return s.configVars[app.Name]
+}
+
+func (s *Server) finishBuild(app *App, b *Build) {
+	status := s.BuildStatus
+	if status == "" {
+		status = "succeeded"
+	}
+	if c := b.SourceBlob.Checksum; c != nil && *c != checksum(s.blobs[strings.TrimPrefix(b.SourceBlob.URL, s.URL)]) {
+		status = "failed"
+	}
+	b.Status = status
+	b.UpdatedAt = time.Now().UTC()
+	if status == "succeeded" {
+		slug := s.newSlug(app)
+		slug.Commit = b.SourceBlob.Version
+		b.Slug = &Ref{ID: slug.ID}
+	}
+}
+
+func (s *Server) newSlug(app *App) *Slug {
+	slug := &Slug{
+		ID:        s.nextID(),
+		Stack:     app.BuildStack,
+		CreatedAt: time.Now().UTC(),
+	}
+	slug.Blob = Blob{Method: "put", URL: s.URL + "/blobs/" + slug.ID}
+	s.slugs[slug.ID] = slug
+	return slug
+}
+
+func (s *Server) newRelease(app *App, slug *Ref) *Release {
+	rel := &Release{
+		ID:        s.nextID(),
+		App:       Named{ID: app.ID, Name: app.Name},
+		Version:   len(s.releases[app.Name]) + 1,
+		Status:    "pending",
+		Slug:      slug,
+		CreatedAt: time.Now().UTC(),
+	}
+	s.releases[app.Name] = append(s.releases[app.Name], rel)
+	if s.ReleaseOutput != "" {
+		url := s.URL + "/streams/" + rel.ID
+		rel.OutputStreamURL = &url
+		s.pending[rel.ID] = s.ReleasePolls
+	} else {
+		s.finishRelease(app, rel)
+	}
+	return rel
+}
+
+func (s *Server) finishRelease(app *App, rel *Release) {
+	status := s.ReleaseStatus
+	if status == "" || rel.OutputStreamURL == nil {
+		status = "succeeded"
+	}
+	rel.Status = status
+	rel.UpdatedAt = time.Now().UTC()
+	if status == "succeeded" {
+		for _, r := range s.releases[app.Name] {
+			r.Current = false
+		}
+		rel.Current = true
+	}
+}
+
+// dockerReleases reports whether a request uses the docker-releases variant
+// of the API, which alone exposes formation images.
+func dockerReleases(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "version=3.docker-releases")
+}
+
+// descending reports whether a list request's Range header asks for
+// newest first.
+func descending(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Range"), "order=desc")
+}
+
+// rangeMax returns the max= limit of a list request's Range header, or 0.
+func rangeMax(r *http.Request) int {
+	for _, part := range strings.FieldsFunc(r.Header.Get("Range"), func(c rune) bool { return c == ';' || c == ',' }) {
+		var max int
+		if _, err := fmt.Sscanf(strings.TrimSpace(part), "max=%d", &max); err == nil {
+			return max
+		}
+	}
+	return 0
+}
+
+func checksum(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Request-Id", fmt.Sprintf("req-%d", time.Now().UnixNano()))
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, id, message string) {
+	writeJSON(w, code, map[string]string{"id": id, "message": message})
+}
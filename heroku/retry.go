@@ -0,0 +1,229 @@
+package heroku
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Error is a Platform API request that failed, after any retries.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	RequestID  string
+	Attempts   int
+
+	// ID and Message come from the API's JSON error body, e.g. "not_found".
+	ID      string
+	Message string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	s := fmt.Sprintf("heroku: %d %s", e.StatusCode, msg)
+	if e.ID != "" {
+		s += " (" + e.ID + ")"
+	}
+	if e.RequestID != "" {
+		s += ", request ID " + e.RequestID
+	}
+	if e.Attempts > 1 {
+		s += fmt.Sprintf(", after %d attempts", e.Attempts)
+	}
+	return s
+}
+
+// RetryTransport retries requests that fail with a network error, a 429 or
+// a 5xx, using jittered exponential backoff. Non-idempotent requests,
+// including PATCHes that may create a release, are only retried when the
+// API rejected them outright with a 429. Request bodies are
+// replayed through http.Request.GetBody; requests without one are sent once.
+type RetryTransport struct {
+	// Transport performs the individual attempts; http.DefaultTransport if nil.
+	Transport http.RoundTripper
+
+	// MaxRetries is the number of attempts after the first one.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound the delay between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// APIErrors turns the final non-2xx response into an *Error carrying
+	// the request ID, instead of returning the response.
+	APIErrors bool
+
+	mu        sync.Mutex
+	remaining int
+	limited   bool
+}
+
+// NewRetryTransport returns a RetryTransport with the plugin's defaults.
+func NewRetryTransport(t http.RoundTripper) *RetryTransport {
+	return &RetryTransport{
+		Transport:  t,
+		MaxRetries: 5,
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+// rateLimitFloor is the RateLimit-Remaining value below which requests are
+// spaced out to the API's refill rate of roughly 75 requests a minute.
+const (
+	rateLimitFloor    = 10
+	rateLimitInterval = time.Minute / 75
+)
+
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.throttle(req); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.transport().RoundTrip(req)
+		if err == nil {
+			t.observe(resp)
+		}
+
+		if attempt >= t.MaxRetries || !t.retryable(req, resp, err) {
+			if err == nil && t.APIErrors && resp.StatusCode/100 != 2 {
+				return nil, newError(req, resp, attempt+1)
+			}
+			return resp, err
+		}
+
+		wait := t.backoff(attempt, resp)
+		if resp != nil {
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (t *RetryTransport) transport() http.RoundTripper {
+	if t.Transport != nil {
+		return t.Transport
+	}
+	return http.DefaultTransport
+}
+
+func (t *RetryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Body != nil && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return req.Context().Err() == nil && idempotent(req.Method)
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode >= 500 && resp.StatusCode != http.StatusNotImplemented:
+		return idempotent(req.Method)
+	}
+	return false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (t *RetryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s >= 0 {
+			if d := time.Duration(s) * time.Second; d < t.MaxBackoff {
+				return d
+			}
+			return t.MaxBackoff
+		}
+	}
+
+	d := t.MinBackoff << uint(attempt)
+	if d <= 0 || d > t.MaxBackoff {
+		d = t.MaxBackoff
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests && d < rateLimitInterval {
+		d = rateLimitInterval
+	}
+	// Full jitter over the upper half of the window keeps concurrent
+	// components from retrying in lockstep.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// observe records the API's remaining rate limit budget.
+func (t *RetryTransport) observe(resp *http.Response) {
+	n, err := strconv.Atoi(resp.Header.Get("RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.remaining = n
+	t.limited = true
+	t.mu.Unlock()
+}
+
+// throttle delays the request when the rate limit budget is nearly spent.
+func (t *RetryTransport) throttle(req *http.Request) error {
+	t.mu.Lock()
+	low := t.limited && t.remaining < rateLimitFloor
+	t.mu.Unlock()
+	if !low {
+		return nil
+	}
+
+	select {
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-time.After(rateLimitInterval):
+		return nil
+	}
+}
+
+func newError(req *http.Request, resp *http.Response, attempts int) *Error {
+	defer resp.Body.Close()
+
+	e := &Error{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("Request-Id"),
+		Attempts:   attempts,
+	}
+	var body struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err == nil {
+		e.ID = body.ID
+		e.Message = body.Message
+	}
+	return e
+}
@@ -0,0 +1,144 @@
+package heroku
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryTransport() *RetryTransport {
+	rt := NewRetryTransport(nil)
+	rt.MinBackoff = time.Millisecond
+	rt.MaxBackoff = 5 * time.Millisecond
+	rt.APIErrors = true
+	return rt
+}
+
+// flakyServer fails the first n requests with code.
+func flakyServer(n int32, code int) (*httptest.Server, *int32) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Request-Id", fmt.Sprintf("req-%d", atomic.LoadInt32(&calls)))
+		if atomic.AddInt32(&calls, 1) <= n {
+			w.WriteHeader(code)
+			fmt.Fprint(w, `{"id":"unavailable","message":"API is unavailable"}`)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	return srv, &calls
+}
+
+func TestRetryTransportRetriesIdempotent(t *testing.T) {
+	srv, calls := flakyServer(2, http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	c := &http.Client{Transport: testRetryTransport()}
+	req, _ := http.NewRequest("PUT", srv.URL, strings.NewReader(`{"a":1}`))
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if *calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", *calls)
+	}
+}
+
+func TestRetryTransportDoesNotRetryPostOrPatchOn5xx(t *testing.T) {
+	for _, method := range []string{"POST", "PATCH"} {
+		srv, calls := flakyServer(1, http.StatusInternalServerError)
+		defer srv.Close()
+
+		c := &http.Client{Transport: testRetryTransport()}
+		req, _ := http.NewRequest(method, srv.URL, strings.NewReader(`{}`))
+		_, err := c.Do(req)
+
+		var apiErr *Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%s: expected *Error, got %v", method, err)
+		}
+		if *calls != 1 {
+			t.Errorf("%s: expected 1 attempt, got %d", method, *calls)
+		}
+	}
+}
+
+func TestRetryTransportRetriesPostOn429(t *testing.T) {
+	srv, calls := flakyServer(1, http.StatusTooManyRequests)
+	defer srv.Close()
+
+	c := &http.Client{Transport: testRetryTransport()}
+
+	start := time.Now()
+	resp, err := c.Post(srv.URL, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if *calls != 2 {
+		t.Errorf("expected 2 attempts, got %d", *calls)
+	}
+	if time.Since(start) < rateLimitInterval/2 {
+		t.Errorf("expected a rate limit backoff, retried after %s", time.Since(start))
+	}
+}
+
+func TestRetryTransportCapsRetryAfter(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: testRetryTransport()}
+	start := time.Now()
+	resp, err := c.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 attempts, got %d", n)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected Retry-After to be capped at MaxBackoff, retried after %s", time.Since(start))
+	}
+}
+
+func TestRetryTransportFinalError(t *testing.T) {
+	srv, calls := flakyServer(100, http.StatusServiceUnavailable)
+	defer srv.Close()
+
+	rt := testRetryTransport()
+	rt.MaxRetries = 2
+	c := &http.Client{Transport: rt}
+	_, err := c.Get(srv.URL)
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if apiErr.Attempts != 3 || *calls != 3 {
+		t.Errorf("expected 3 attempts, got %d (%d calls)", apiErr.Attempts, *calls)
+	}
+	if apiErr.RequestID != "req-2" || apiErr.ID != "unavailable" {
+		t.Errorf("unexpected error details %+v", apiErr)
+	}
+	if !strings.Contains(err.Error(), "request ID req-2") {
+		t.Errorf("error %q does not mention the request ID", err)
+	}
+}
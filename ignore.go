@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultIgnores are never worth shipping to Heroku; Heroku's own git push
+// doesn't include them either. They can be re-added with `include`.
+var defaultIgnores = []string{".git/"}
+
+// ignoreRule is a single gitignore-style pattern.
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules decides which paths are left out of an archive. Later rules
+// win, so includes are appended last to re-add anything excluded before.
+type ignoreRules []ignoreRule
+
+// newIgnoreRules collects the rules for archiving src: the defaults, then
+// src/.slugignore, then src/.gitignore if gitignore is set, then the
+// configured excludes and includes. Only the top-level ignore files are read.
+func newIgnoreRules(src string, exclude, include []string, gitignore bool) (ignoreRules, error) {
+	patterns := append([]string(nil), defaultIgnores...)
+
+	files := []string{".slugignore"}
+	if gitignore {
+		files = append(files, ".gitignore")
+	}
+	for _, name := range files {
+		lines, err := readIgnoreFile(filepath.Join(src, name))
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, lines...)
+	}
+	patterns = append(patterns, exclude...)
+	for _, p := range include {
+		patterns = append(patterns, "!"+strings.TrimPrefix(p, "!"))
+	}
+
+	var rules ignoreRules
+	for _, p := range patterns {
+		rule, ok, err := compileIgnore(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+func readIgnoreFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	return lines, s.Err()
+}
+
+// Ignored reports whether the slash-separated path, relative to the archive
+// root, should be left out.
+func (r ignoreRules) Ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, rule := range r {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(path) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// compileIgnore turns a gitignore-style pattern into a rule. It returns false
+// for blank lines and comments.
+func compileIgnore(pattern string) (ignoreRule, bool, error) {
+	p := strings.TrimRight(strings.TrimSuffix(pattern, "\r"), " ")
+	if p == "" || strings.HasPrefix(p, "#") {
+		return ignoreRule{}, false, nil
+	}
+
+	var rule ignoreRule
+	if strings.HasPrefix(p, "!") {
+		rule.negate = true
+		p = p[1:]
+	}
+	if strings.HasSuffix(p, "/") {
+		rule.dirOnly = true
+		p = strings.TrimRight(p, "/")
+	}
+	// Patterns with a slash other than a trailing one are relative to the
+	// root; the rest match at any depth.
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			re.WriteString("(.*/)?")
+			i += 2
+		case p[i:] == "**":
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '\\' && i+1 < len(p):
+			re.WriteString(regexp.QuoteMeta(p[i+1 : i+2]))
+			i++
+		case c == '[' && strings.IndexByte(p[i:], ']') > 1:
+			j := i + strings.IndexByte(p[i:], ']')
+			class := p[i+1 : j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i = j
+		default:
+			re.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return ignoreRule{}, false, fmt.Errorf("invalid ignore pattern %q: %s", pattern, err)
+	}
+	rule.re = compiled
+	return rule, true, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestIgnoreRules(t *testing.T) {
+	var rules ignoreRules
+	for _, p := range []string{
+		"# comment",
+		"",
+		"*.log",
+		"node_modules/",
+		"/secrets",
+		"docs/**/*.md",
+		"!keep.log",
+		"tmp/**",
+	} {
+		rule, ok, err := compileIgnore(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"app.log", false, true},
+		{"logs/app.log", false, true},
+		{"keep.log", false, false},
+		{"node_modules", true, true},
+		{"node_modules", false, false},
+		{"lib/node_modules", true, true},
+		{"secrets", false, true},
+		{"config/secrets", false, false},
+		{"docs/README.md", false, true},
+		{"docs/api/v1/index.md", false, true},
+		{"docs/index.html", false, false},
+		{"tmp/cache/file", false, true},
+		{"index.js", false, false},
+	}
+	for _, c := range cases {
+		if got := rules.Ignored(c.path, c.isDir); got != c.ignored {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", c.path, c.isDir, got, c.ignored)
+		}
+	}
+}
+
+func TestNewIgnoreRules(t *testing.T) {
+	dir := writeSource(t, map[string]string{
+		".slugignore": "*.psd\n",
+		".gitignore":  ".env\n",
+	})
+
+	rules, err := newIgnoreRules(dir, []string{"spec/"}, []string{"fixtures/logo.psd"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.Ignored(".git", true) {
+		t.Error(".git should be ignored by default")
+	}
+	if !rules.Ignored("design.psd", false) {
+		t.Error(".slugignore patterns should apply")
+	}
+	if rules.Ignored(".env", false) {
+		t.Error(".gitignore patterns should only apply when enabled")
+	}
+	if !rules.Ignored("spec", true) {
+		t.Error("configured excludes should apply")
+	}
+	if rules.Ignored("fixtures/logo.psd", false) {
+		t.Error("configured includes should win")
+	}
+
+	rules, err = newIgnoreRules(dir, nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rules.Ignored(".env", false) {
+		t.Error(".gitignore patterns should apply when enabled")
+	}
+}
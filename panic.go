@@ -0,0 +1,24 @@
+package main
+
+import (
+	"runtime/debug"
+
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recoverPanic turns a panic in a component function into an Internal error
+// carrying the stack, so Waypoint records a failure instead of a nil result.
+// It must be deferred directly, with err pointing at the named error result:
+//
+//	defer recoverPanic(log, &err)
+func recoverPanic(log hclog.Logger, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	log.Error("panic", "panic", r, "stack", string(stack))
+	*err = status.Errorf(codes.Internal, "panic: %v\n%s", r, stack)
+}
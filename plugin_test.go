@@ -1,7 +1,1040 @@
 package main
 
-import "testing"
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
 
-func TestTODO(t *testing.T) {
-	// TODO tests
+	"github.com/fanatic/waypoint-plugin-heroku/heroku"
+	"github.com/fanatic/waypoint-plugin-heroku/heroku/herokutest"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/waypoint-plugin-sdk/component"
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServer starts a fake Heroku API with a single "example" app and
+// points every component at it for the duration of the test.
+func newTestServer(t *testing.T) *herokutest.Server {
+	srv := herokutest.NewServer()
+	t.Cleanup(srv.Close)
+	srv.AddApp("example")
+
+	setenv(t, heroku.EnvAPIURL, srv.URL)
+	setenv(t, heroku.EnvAPIKey, "test-key")
+	buildPollInterval = time.Millisecond
+	releasePollInterval = time.Millisecond
+	streamRetryInterval = time.Millisecond
+	return srv
+}
+
+func setenv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// writeSource creates a small Node.js app in a temp directory.
+func writeSource(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "waypoint-plugin-heroku-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if files == nil {
+		files = map[string]string{
+			"Procfile":     "web: node index.js\n",
+			"index.js":     "console.log('hello')\n",
+			"package.json": "{}\n",
+		}
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// tarNames lists the entries of a gzipped tarball.
+func tarNames(t *testing.T, blob []byte) []string {
+	gzr, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gzr)
+
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func testUI() terminal.UI {
+	return terminal.NonInteractiveUI(context.Background())
+}
+
+// gitInit commits everything in dir to a new git repository, returning the
+// commit. The test is skipped if git isn't installed.
+func gitInit(t *testing.T, dir string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s\n%s", args, err, out)
+		}
+	}
+	commit := gitCommit(dir)
+	if len(commit) != 40 {
+		t.Fatalf("unexpected commit %q", commit)
+	}
+	return commit
+}
+
+// fakeGitHub serves acme/example with main at commit to `from = "git"`
+// builds, returning its tarball URL. Requests need the token "gh-token",
+// which is set in the environment.
+func fakeGitHub(t *testing.T, commit string) string {
+	tarball := "https://codeload.github.com/acme/example/legacy.tar.gz/" + commit + "?token=temp"
+	gh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token gh-token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.URL.Path {
+		case "/repos/acme/example/commits/main":
+			fmt.Fprint(w, commit)
+		case "/repos/acme/example/tarball/" + commit:
+			http.Redirect(w, r, tarball, http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(gh.Close)
+	githubAPIURL = gh.URL
+	t.Cleanup(func() { githubAPIURL = "https://api.github.com" })
+	setenv(t, EnvGitHubToken, "gh-token")
+	return tarball
+}
+
+// runBuild builds the source in dir, if any, as job jobID.
+func runBuild(t *testing.T, b *Builder, jobID, dir string) (*Artifact, error) {
+	t.Helper()
+	return b.build(context.Background(), testUI(), &component.JobInfo{Id: jobID}, &component.Source{Path: dir}, hclog.NewNullLogger())
+}
+
+// runDeploy deploys artifact, built from the source in dir if any, as job
+// jobID.
+func runDeploy(t *testing.T, p *Platform, jobID, dir string, artifact *Artifact) (*Deployment, error) {
+	t.Helper()
+	return p.deploy(context.Background(), testUI(), &component.Source{Path: dir}, &component.JobInfo{Id: jobID}, hclog.NewNullLogger(), artifact)
+}
+
+// equal reports whether a and b hold the same strings in the same order.
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuildFromSource(t *testing.T) {
+	srv := newTestServer(t)
+	srv.BuildOutput = "-----> Building on the Heroku-20 stack\n"
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact == nil || artifact.SlugID == "" {
+		t.Fatalf("expected a slug artifact, got %v", artifact)
+	}
+	if srv.Slug(artifact.SlugID) == nil {
+		t.Fatalf("artifact slug %q was not created on the app", artifact.SlugID)
+	}
+	if artifact.Stack != "heroku-20" {
+		t.Errorf("expected the artifact to record stack heroku-20, got %q", artifact.Stack)
+	}
+	for _, r := range srv.Requests() {
+		if r == "PATCH /apps/example" {
+			t.Errorf("build changed the app: %s", r)
+		}
+	}
+
+	builds := srv.Builds()
+	if len(builds) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(builds))
+	}
+	names := tarNames(t, srv.Blob(builds[0].SourceBlob.URL))
+	if want := []string{"Procfile", "index.js", "package.json"}; !equal(names, want) {
+		t.Errorf("source archive contains %v, want %v", names, want)
+	}
+}
+
+func TestBuildFromSourceIgnoresFiles(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, map[string]string{
+		"Procfile":                 "web: node index.js\n",
+		"index.js":                 "console.log('hello')\n",
+		".slugignore":              "*.psd\n",
+		".git/HEAD":                "ref: refs/heads/main\n",
+		"design.psd":               "",
+		"node_modules/x/index.js":  "",
+		"node_modules/x/README.md": "",
+	})
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example", Exclude: []string{"node_modules/"}}}
+	_, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := tarNames(t, srv.Blob(srv.Builds()[0].SourceBlob.URL))
+	if want := []string{".slugignore", "Procfile", "index.js"}; !equal(names, want) {
+		t.Errorf("source archive contains %v, want %v", names, want)
+	}
+}
+
+func TestBuildFromSourceReusesCachedBuild(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example"}}
+	first, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := runBuild(t, b, "job-2", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.SlugID != first.SlugID {
+		t.Errorf("expected the cached slug %q, got %q", first.SlugID, second.SlugID)
+	}
+	if n := len(srv.Builds()); n != 1 {
+		t.Errorf("expected 1 build, got %d", n)
+	}
+
+	b.config.DisableCache = true
+	if _, err := runBuild(t, b, "job-3", dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 2 {
+		t.Errorf("expected a fresh build with the cache disabled, got %d builds", n)
+	}
+}
+
+func TestBuildFromSourceBuildpacks(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	buildpacks := []string{"heroku/nodejs", "https://example.com/buildpack.tgz"}
+	b := &Builder{config: BuildConfig{From: "source", App: "example", Buildpacks: buildpacks, PersistBuildpacks: true}}
+	if _, err := runBuild(t, b, "job-1", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.Builds()[0].Buildpacks
+	want := []herokutest.Buildpack{{Name: "heroku/nodejs"}, {URL: "https://example.com/buildpack.tgz"}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("build used buildpacks %v, want %v", got, want)
+	}
+	if installed := srv.Buildpacks("example"); !equal(installed, buildpacks) {
+		t.Errorf("app has buildpacks %v, want %v", installed, buildpacks)
+	}
+
+	b.config.Buildpacks = buildpacks[:1]
+	if _, err := runBuild(t, b, "job-2", dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 2 {
+		t.Errorf("expected a fresh build after changing buildpacks, got %d builds", n)
+	}
+}
+
+func TestBuildFromSourceEnvAndCommit(t *testing.T) {
+	srv := newTestServer(t)
+	srv.AddApp("example-builder")
+	dir := writeSource(t, map[string]string{
+		"Procfile":   "web: node index.js\n",
+		"index.js":   "console.log('hello')\n",
+		".gitignore": "*.log\n",
+	})
+	commit := gitInit(t, dir)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example", BuildApp: "example-builder", Env: map[string]string{"NODE_ENV": "production"}}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := srv.ConfigVars("example-builder")["NODE_ENV"]; v != "production" {
+		t.Errorf("expected NODE_ENV=production on the build app, got %q", v)
+	}
+	if n := len(srv.ConfigVars("example")); n != 0 {
+		t.Errorf("expected the deploy app's config vars to be left alone, got %d", n)
+	}
+	if v := srv.Builds()[0].SourceBlob.Version; v == nil || !strings.HasPrefix(*v, commit+"+env.") {
+		t.Errorf("expected source version %s with an env hash, got %v", commit, v)
+	}
+	if artifact.Commit != commit {
+		t.Errorf("expected the artifact to record commit %s, got %q", commit, artifact.Commit)
+	}
+
+	if _, err := runBuild(t, b, "job-2", dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 1 {
+		t.Errorf("expected the build to be reused with unchanged env, got %d builds", n)
+	}
+	b.config.Env["NODE_ENV"] = "staging"
+	if _, err := runBuild(t, b, "job-3", dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 2 {
+		t.Errorf("expected a fresh build after changing env, got %d builds", n)
+	}
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	if _, err := runDeploy(t, p, "job-4", dir, artifact); err != nil {
+		t.Fatal(err)
+	}
+	if desc := srv.Releases("example")[0].Description; desc != "Deploy "+commit[:8] {
+		t.Errorf("unexpected release description %q", desc)
+	}
+}
+
+func TestBuildFromSourceEnvRevert(t *testing.T) {
+	srv := newTestServer(t)
+	srv.AddApp("example-builder")
+	dir := writeSource(t, nil)
+	setSource := func(contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "index.js"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example", BuildApp: "example-builder", Env: map[string]string{"NODE_ENV": "a"}}}
+	first, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSource("console.log('changed')\n")
+	b.config.Env["NODE_ENV"] = "b"
+	if _, err := runBuild(t, b, "job-2", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// The source is back to the first build's, but the env isn't, even
+	// though this run doesn't change it.
+	setSource("console.log('hello')\n")
+	reverted, err := runBuild(t, b, "job-3", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 3 || reverted.SlugID == first.SlugID {
+		t.Errorf("expected a new build of the first source under the new env, got %d builds", n)
+	}
+
+	b.config.Env["NODE_ENV"] = "a"
+	again, err := runBuild(t, b, "job-4", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 3 || again.SlugID != first.SlugID {
+		t.Errorf("expected the first build to be reused under its own env, got %d builds", n)
+	}
+}
+
+func TestBuildFromSourceWaitsForPendingBuild(t *testing.T) {
+	srv := newTestServer(t)
+	srv.BuildPolls = 3
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.SlugID == "" {
+		t.Fatal("expected a slug artifact")
+	}
+}
+
+func TestBuildFromSourceSwitchesContainerApp(t *testing.T) {
+	srv := newTestServer(t)
+	srv.App("example").BuildStack.Name = "container"
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example", Stack: "heroku-22", RestoreStack: true}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if artifact.Stack != "heroku-22" {
+		t.Errorf("expected the artifact to record stack heroku-22, got %q", artifact.Stack)
+	}
+	if stack := srv.Builds()[0].Stack; stack != "heroku-22" {
+		t.Errorf("expected the build to run on heroku-22, got %q", stack)
+	}
+	if stack := srv.App("example").BuildStack.Name; stack != "container" {
+		t.Errorf("expected the app to be switched back to container, got %q", stack)
+	}
+}
+
+func TestBuildFromSourceSwitchesContainerAppToDefaultStack(t *testing.T) {
+	srv := newTestServer(t)
+	srv.App("example").BuildStack.Name = "container"
+	srv.DefaultStack = "heroku-22"
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stack := srv.Builds()[0].Stack; stack != "heroku-22" || artifact.Stack != "heroku-22" {
+		t.Errorf("expected the build to run on the default stack heroku-22, got %q", stack)
+	}
+}
+
+func TestBuildFromSourceStackMismatch(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example", Stack: "heroku-18"}}
+	_, err := runBuild(t, b, "job-1", dir)
+	if err == nil || !strings.Contains(err.Error(), "heroku-18") {
+		t.Fatalf("expected a stack mismatch error, got %v", err)
+	}
+	if n := len(srv.Builds()); n != 0 {
+		t.Errorf("expected no builds, got %d", n)
+	}
+	if stack := srv.App("example").BuildStack.Name; stack != "heroku-20" {
+		t.Errorf("expected the app to stay on heroku-20, got %q", stack)
+	}
+}
+
+func TestBuildFromSourceFailed(t *testing.T) {
+	srv := newTestServer(t)
+	srv.BuildStatus = "failed"
+	srv.BuildOutput = "-----> Node.js app detected\n ! Push rejected, failed to compile Node.js app.\n"
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if artifact != nil {
+		t.Errorf("expected no artifact, got %v", artifact)
+	}
+
+	var buildErr *BuildFailedError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("expected *BuildFailedError, got %v", err)
+	}
+	if buildErr.BuildID == "" || buildErr.Status != "failed" {
+		t.Errorf("unexpected error details %+v", buildErr)
+	}
+	if !strings.Contains(err.Error(), "failed to compile") {
+		t.Errorf("error %q does not include the build output", err)
+	}
+}
+
+func TestBuildFromURL(t *testing.T) {
+	srv := newTestServer(t)
+
+	url := "https://example.com/app.tar.gz"
+	b := &Builder{config: BuildConfig{From: "url", App: "example", URL: url}}
+	for _, id := range []string{"job-1", "job-2"} {
+		if _, err := runBuild(t, b, id, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	builds := srv.Builds()
+	if len(builds) != 2 {
+		t.Fatalf("expected remote URLs to always be built, got %d builds", len(builds))
+	}
+	if got := builds[0].SourceBlob; got.URL != url || got.Checksum != nil {
+		t.Errorf("unexpected source blob %+v", got)
+	}
+}
+
+func TestBuildFromGit(t *testing.T) {
+	srv := newTestServer(t)
+
+	const commit = "0123456789abcdef0123456789abcdef01234567"
+	tarball := fakeGitHub(t, commit)
+
+	b := &Builder{config: BuildConfig{From: "git", App: "example", Repo: "acme/example", Ref: "main"}}
+	artifact, err := runBuild(t, b, "job-1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.Commit != commit {
+		t.Errorf("expected the artifact to record commit %s, got %q", commit, artifact.Commit)
+	}
+	build := srv.Builds()[0]
+	if build.SourceBlob.URL != tarball {
+		t.Errorf("built %q, want %q", build.SourceBlob.URL, tarball)
+	}
+	if v := build.SourceBlob.Version; v == nil || *v != commit {
+		t.Errorf("expected source version %s, got %v", commit, v)
+	}
+
+	if _, err := runBuild(t, b, "job-2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Builds()); n != 1 {
+		t.Errorf("expected the build of the same commit to be reused, got %d builds", n)
+	}
+
+	b.config.Ref = "missing"
+	if _, err := runBuild(t, b, "job-3", ""); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a not found error for an unknown ref, got %v", err)
+	}
+}
+
+func TestBuildFromSourceDoesNotReuseBuildOfCommit(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+	commit := gitInit(t, dir)
+	fakeGitHub(t, commit)
+
+	b := &Builder{config: BuildConfig{From: "git", App: "example", Repo: "acme/example", Ref: "main"}}
+	if _, err := runBuild(t, b, "job-1", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The working tree is still on the commit built above, but has changes.
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.js"), []byte("console.log('changed')\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b.config = BuildConfig{From: "source", App: "example"}
+	if _, err := runBuild(t, b, "job-2", dir); err != nil {
+		t.Fatal(err)
+	}
+	builds := srv.Builds()
+	if len(builds) != 2 {
+		t.Fatalf("expected a new build of the changed working tree, got %d builds", len(builds))
+	}
+	if builds[1].SourceBlob.Checksum == nil {
+		t.Errorf("expected the source build to have a checksum, got %+v", builds[1].SourceBlob)
+	}
+}
+
+func TestBuildFromArchive(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slug := srv.Slug(artifact.SlugID)
+	if slug == nil {
+		t.Fatalf("artifact slug %q was not created on the app", artifact.SlugID)
+	}
+	if got := slug.ProcessTypes["web"]; got != "node index.js" {
+		t.Errorf("web process type is %q", got)
+	}
+	names := tarNames(t, srv.Blob(slug.Blob.URL))
+	if want := []string{"./app/", "./app/Procfile", "./app/index.js", "./app/package.json"}; !equal(names, want) {
+		t.Errorf("slug archive contains %v, want %v", names, want)
+	}
+	if slug.Checksum == nil || !strings.HasPrefix(*slug.Checksum, "SHA256:") {
+		t.Errorf("slug created without a checksum: %v", slug.Checksum)
+	}
+}
+
+func TestBuildFromArchiveStreamed(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example", Stream: true}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slug := srv.Slug(artifact.SlugID)
+	names := tarNames(t, srv.Blob(slug.Blob.URL))
+	if want := []string{"./app/", "./app/Procfile", "./app/index.js", "./app/package.json"}; !equal(names, want) {
+		t.Errorf("slug archive contains %v, want %v", names, want)
+	}
+}
+
+func TestBuildFromArchiveMissingProcfileTarget(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, map[string]string{
+		"Procfile":   "web: bin/server --port $PORT\nworker: node lib/worker.js\n",
+		"bin/server": "",
+	})
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	_, err := runBuild(t, b, "job-1", dir)
+	if err == nil || !strings.Contains(err.Error(), "worker: lib/worker.js not found") {
+		t.Fatalf("expected a missing file error for the worker, got %v", err)
+	}
+	for _, r := range srv.Requests() {
+		if strings.Contains(r, "/slugs") {
+			t.Errorf("slug created despite an invalid Procfile: %s", r)
+		}
+	}
+}
+
+func TestBuildFromArchiveRejectedUpload(t *testing.T) {
+	srv := newTestServer(t)
+	srv.RejectUploads = true
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	_, err := runBuild(t, b, "job-1", dir)
+
+	var blobErr *heroku.BlobError
+	if !errors.As(err, &blobErr) {
+		t.Fatalf("expected *heroku.BlobError, got %v", err)
+	}
+	if blobErr.Code != "AccessDenied" {
+		t.Errorf("unexpected error details %+v", blobErr)
+	}
+}
+
+func TestBuildFromExisting(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	built, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Platform{config: DeployConfig{App: "example"}}
+	if _, err := runDeploy(t, p, "job-2", dir, built); err != nil {
+		t.Fatal(err)
+	}
+
+	b = &Builder{config: BuildConfig{From: "existing", App: "example"}}
+	artifact, err := runBuild(t, b, "job-3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.SlugID != built.SlugID || artifact.App != "example" {
+		t.Errorf("expected the current slug %q of example, got %+v", built.SlugID, artifact)
+	}
+
+	srv.AddApp("example-builder")
+	b.config.BuildApp = "example-builder"
+	artifact, err = runBuild(t, b, "job-3", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.SlugID != built.SlugID || artifact.App != "example" {
+		t.Errorf("expected the current slug %q of example with a build app set, got %+v", built.SlugID, artifact)
+	}
+	b.config.BuildApp = ""
+
+	artifact = &Artifact{ContainerImageDigest: "sha256:abc"}
+	if _, err := runDeploy(t, p, "job-4", "", artifact); err != nil {
+		t.Fatal(err)
+	}
+	artifact, err = runBuild(t, b, "job-5", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.ContainerImageDigest != "sha256:abc" || artifact.SlugID != "" || !equal(artifact.ProcessTypes, []string{"web"}) {
+		t.Errorf("expected the current image sha256:abc, got %+v", artifact)
+	}
+
+	srv.AddApp("empty")
+	b.config.App = "empty"
+	if _, err := runBuild(t, b, "job-6", ""); err == nil {
+		t.Error("expected an error for an app without releases")
+	}
+}
+
+func TestBuildInvalidFrom(t *testing.T) {
+	newTestServer(t)
+
+	b := &Builder{config: BuildConfig{From: "nope", App: "example"}}
+	_, err := runBuild(t, b, "job-1", ".")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestDeploySlug(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	deployment, err := runDeploy(t, p, "job-2", dir, artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deployment.Url != "https://example.herokuapp.com/" {
+		t.Errorf("unexpected deployment URL %q", deployment.Url)
+	}
+
+	releases := srv.Releases("example")
+	if len(releases) != 1 {
+		t.Fatalf("expected 1 release, got %d", len(releases))
+	}
+	if releases[0].Slug.ID != artifact.SlugID {
+		t.Errorf("released slug %q, want %q", releases[0].Slug.ID, artifact.SlugID)
+	}
+
+	app := srv.App("example")
+	if artifact.AppID != app.ID || artifact.CreatedAt == nil {
+		t.Errorf("expected the artifact to record app %s and a creation time, got %+v", app.ID, artifact)
+	}
+	if deployment.App != "example" || deployment.AppID != app.ID || deployment.SlugID != artifact.SlugID {
+		t.Errorf("unexpected deployment %+v", deployment)
+	}
+	if deployment.ReleaseID != releases[0].ID || deployment.Version != 1 {
+		t.Errorf("expected deployment of release %s v1, got %s v%d", releases[0].ID, deployment.ReleaseID, deployment.Version)
+	}
+	if !deployment.CreatedAt.AsTime().Equal(releases[0].CreatedAt) {
+		t.Errorf("deployment created at %s, release at %s", deployment.CreatedAt.AsTime(), releases[0].CreatedAt)
+	}
+}
+
+func TestDeploySlugWaitsForReleasePhase(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.ReleaseOutput = "Running release command...\nMigrations complete\n"
+	srv.ReleasePolls = 2
+	p := &Platform{config: DeployConfig{App: "example"}}
+	if _, err := runDeploy(t, p, "job-2", dir, artifact); err != nil {
+		t.Fatal(err)
+	}
+	if rel := srv.Releases("example")[0]; rel.Status != "succeeded" || !rel.Current {
+		t.Errorf("expected a current, succeeded release, got %+v", rel)
+	}
+
+	srv.ReleaseOutput = "Running release command...\nmigration failed\n"
+	srv.ReleaseStatus = "failed"
+	srv.StreamMisses = 2
+	_, err = runDeploy(t, p, "job-3", dir, artifact)
+	var failed *ReleaseFailedError
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected a ReleaseFailedError, got %v", err)
+	}
+	if failed.Version != 2 || failed.Status != "failed" {
+		t.Errorf("unexpected error %+v", failed)
+	}
+	if !strings.Contains(err.Error(), "v2") || !strings.Contains(err.Error(), "migration failed") || strings.Contains(err.Error(), "not_found") {
+		t.Errorf("expected the version and release output, once the stream existed, in %q", err)
+	}
+	if rel := srv.Releases("example")[0]; !rel.Current {
+		t.Error("expected the previous release to stay current")
+	}
+
+	srv.StreamMisses = streamRetries + 1
+	if _, err := runDeploy(t, p, "job-4", dir, artifact); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected an error for an output stream that never appears, got %v", err)
+	}
+}
+
+func TestDeploySlugFromBuildApp(t *testing.T) {
+	srv := newTestServer(t)
+	builder := srv.AddApp("example-builder")
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example", BuildApp: "example-builder"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if artifact.App != "example-builder" {
+		t.Errorf("expected the artifact to be owned by example-builder, got %q", artifact.App)
+	}
+	if build := srv.Builds()[0]; build.App.ID != builder.ID {
+		t.Errorf("expected the build on example-builder, got app %s", build.App.ID)
+	}
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	if _, err := runDeploy(t, p, "job-2", dir, artifact); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Releases("example-builder")); n != 0 {
+		t.Errorf("expected no releases on the build app, got %d", n)
+	}
+	releases := srv.Releases("example")
+	if len(releases) != 1 || releases[0].Slug.ID != artifact.SlugID {
+		t.Errorf("expected slug %q released on example, got %v", artifact.SlugID, releases)
+	}
+}
+
+func TestDeployContainer(t *testing.T) {
+	srv := newTestServer(t)
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	artifact := &Artifact{ContainerImageDigest: "sha256:abc"}
+	deployment, err := runDeploy(t, p, "job-1", "", artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	formation := srv.Formation("example")
+	if len(formation) != 1 || formation[0].Type != "web" || formation[0].DockerImage != "sha256:abc" {
+		t.Errorf("unexpected formation updates %+v", formation)
+	}
+	releases := srv.Releases("example")
+	if len(releases) != 1 || !releases[0].Current {
+		t.Fatalf("expected the formation update to create a current release, got %+v", releases)
+	}
+	if deployment.ReleaseID != releases[0].ID || deployment.Version != 1 || deployment.ContainerImageDigest != "sha256:abc" {
+		t.Errorf("unexpected deployment %+v", deployment)
+	}
+
+	// A config var change released at the same time isn't the deployment.
+	srv.ConcurrentReleases = 1
+	artifact = &Artifact{ContainerImageDigest: "sha256:def"}
+	deployment, err = runDeploy(t, p, "job-2", "", artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases = srv.Releases("example")
+	if len(releases) != 3 {
+		t.Fatalf("expected a container release and a config var release, got %+v", releases)
+	}
+	if deployment.ReleaseID != releases[1].ID || deployment.Version != 2 {
+		t.Errorf("expected the deployment of release %s v2, got %s v%d", releases[1].ID, deployment.ReleaseID, deployment.Version)
+	}
+}
+
+func TestDeployContainerProcessTypes(t *testing.T) {
+	srv := newTestServer(t)
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	artifact := &Artifact{ContainerImageDigest: "sha256:abc", ProcessTypes: []string{"release", "web", "worker"}}
+	if _, err := runDeploy(t, p, "job-1", "", artifact); err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, u := range srv.Formation("example") {
+		if u.DockerImage != "sha256:abc" {
+			t.Errorf("unexpected image for %s: %q", u.Type, u.DockerImage)
+		}
+		types = append(types, u.Type)
+	}
+	if !equal(types, artifact.ProcessTypes) {
+		t.Errorf("released %v, want %v", types, artifact.ProcessTypes)
+	}
+	if n := len(srv.Releases("example")); n != 1 {
+		t.Errorf("expected a single batch update and release, got %d releases", n)
+	}
+
+	p.config.ProcessTypes = []string{"web", "clock"}
+	if _, err := runDeploy(t, p, "job-2", "", artifact); err == nil || !strings.Contains(err.Error(), `"clock"`) {
+		t.Errorf("expected an error for a process type that wasn't pushed, got %v", err)
+	}
+}
+
+func TestDeployMissingArtifact(t *testing.T) {
+	newTestServer(t)
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	_, err := runDeploy(t, p, "job-1", "", &Artifact{})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	r := &Releaser{}
+	release, err := r.release(context.Background(), testUI(), &component.Source{}, &component.JobInfo{}, hclog.NewNullLogger(), &Deployment{Url: "https://example.herokuapp.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if release.URL() != "https://example.herokuapp.com/" {
+		t.Errorf("unexpected release URL %q", release.URL())
+	}
+}
+
+func TestDestroyRollback(t *testing.T) {
+	srv := newTestServer(t)
+	dir := writeSource(t, nil)
+
+	b := &Builder{config: BuildConfig{From: "archive", App: "example"}}
+	artifact, err := runBuild(t, b, "job-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	var deployments []*Deployment
+	for _, id := range []string{"job-2", "job-3"} {
+		deployment, err := runDeploy(t, p, id, dir, artifact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deployments = append(deployments, deployment)
+	}
+
+	if err := p.destroy(context.Background(), testUI(), hclog.NewNullLogger(), deployments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(srv.Releases("example")); n != 2 {
+		t.Fatalf("expected destroying a superseded deployment to leave the app alone, got %d releases", n)
+	}
+
+	if err := p.destroy(context.Background(), testUI(), hclog.NewNullLogger(), deployments[1]); err != nil {
+		t.Fatal(err)
+	}
+	releases := srv.Releases("example")
+	if len(releases) != 3 {
+		t.Fatalf("expected a rollback release, got %d releases", len(releases))
+	}
+	if rel := releases[2]; !rel.Current || rel.Description != "Rollback to v1" || rel.Slug.ID != releases[0].Slug.ID {
+		t.Errorf("unexpected rollback release %+v", rel)
+	}
+}
+
+func TestDestroyScaleDown(t *testing.T) {
+	srv := newTestServer(t)
+
+	p := &Platform{config: DeployConfig{App: "example", OnDestroy: "scale_down"}}
+	artifact := &Artifact{ContainerImageDigest: "sha256:abc", ProcessTypes: []string{"web", "worker"}}
+	deployment, err := runDeploy(t, p, "job-1", "", artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.destroy(context.Background(), testUI(), hclog.NewNullLogger(), deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	scaled := map[string]bool{}
+	for _, u := range srv.Formation("example") {
+		if u.Quantity != nil && *u.Quantity == 0 {
+			scaled[u.Type] = true
+		}
+	}
+	if !scaled["web"] || !scaled["worker"] {
+		t.Errorf("expected web and worker scaled to zero, got %+v", srv.Formation("example"))
+	}
+	if n := len(srv.Releases("example")); n != 1 {
+		t.Errorf("expected scaling down not to release, got %d releases", n)
+	}
+}
+
+func TestDestroyDelete(t *testing.T) {
+	srv := newTestServer(t)
+	srv.AddApp("example-pr-1")
+
+	p := &Platform{config: DeployConfig{App: "example-pr-1", OnDestroy: "delete"}}
+	var deployments []*Deployment
+	for _, image := range []string{"sha256:abc", "sha256:def"} {
+		deployment, err := runDeploy(t, p, "job-"+image, "", &Artifact{ContainerImageDigest: image})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deployments = append(deployments, deployment)
+	}
+
+	if err := p.destroy(context.Background(), testUI(), hclog.NewNullLogger(), deployments[0]); err != nil {
+		t.Fatal(err)
+	}
+	if srv.App("example-pr-1") == nil {
+		t.Fatal("expected destroying a superseded deployment to keep the app serving the current one")
+	}
+
+	if err := p.destroy(context.Background(), testUI(), hclog.NewNullLogger(), deployments[1]); err != nil {
+		t.Fatal(err)
+	}
+	if srv.App("example-pr-1") != nil {
+		t.Error("expected example-pr-1 to be deleted")
+	}
+	if srv.App("example") == nil {
+		t.Error("expected other apps to be left alone")
+	}
+
+	// Waypoint validates the configuration before destroying again.
+	if err := p.ConfigSet(&p.config); err != nil {
+		t.Errorf("expected the deleted app to pass validation, got %v", err)
+	}
+	if err := p.destroy(context.Background(), testUI(), hclog.NewNullLogger(), deployments[0]); err != nil {
+		t.Errorf("expected destroying a deployment of a deleted app to succeed, got %v", err)
+	}
+}
+
+func TestPanicsBecomeErrors(t *testing.T) {
+	newTestServer(t)
+
+	b := &Builder{config: BuildConfig{From: "source", App: "example"}}
+	artifact, err := b.build(context.Background(), testUI(), &component.JobInfo{Id: "job-1"}, nil, hclog.NewNullLogger())
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "panic") || artifact != nil {
+		t.Errorf("expected an Internal error from a panicking build, got %v, %v", artifact, err)
+	}
+
+	r := &Releaser{}
+	release, err := r.release(context.Background(), testUI(), &component.Source{}, &component.JobInfo{}, hclog.NewNullLogger(), nil)
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "runtime/debug.Stack") || release != nil {
+		t.Errorf("expected an Internal error with a stack from a panicking release, got %v, %v", release, err)
+	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
+)
+
+// progressInterval limits how often upload progress is redrawn.
+var progressInterval = 500 * time.Millisecond
+
+// withProgress returns a copy of a whose readers report how much of the
+// archive has been sent, prefixed by msg, on step. The copy doesn't own the
+// archive; close the original.
+func (a *localArchive) withProgress(step terminal.Step, msg string) *localArchive {
+	c := *a
+	c.close = nil
+	c.Open = func() (io.ReadCloser, error) {
+		r, err := a.Open()
+		if err != nil {
+			return nil, err
+		}
+		return &progressReader{ReadCloser: r, step: step, msg: msg, total: a.Size, start: time.Now()}, nil
+	}
+	return &c
+}
+
+// progressReader reports bytes read, percentage and throughput to a step.
+// Each upload attempt gets a fresh reader, so progress restarts on retry.
+type progressReader struct {
+	io.ReadCloser
+	step  terminal.Step
+	msg   string
+	total int64
+
+	read  int64
+	start time.Time
+	last  time.Time
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+
+	if now := time.Now(); now.Sub(r.last) >= progressInterval || err == io.EOF {
+		r.last = now
+		r.step.Update("%s %s", r.msg, r.progress(now))
+	}
+	return n, err
+}
+
+func (r *progressReader) progress(now time.Time) string {
+	s := formatBytes(r.read)
+	if r.total > 0 {
+		s = fmt.Sprintf("%s / %s (%d%%)", s, formatBytes(r.total), r.read*100/r.total)
+	}
+	if elapsed := now.Sub(r.start).Seconds(); elapsed > 0 {
+		s += fmt.Sprintf(", %s/s", formatBytes(int64(float64(r.read)/elapsed)))
+	}
+	return s
+}
+
+// formatBytes renders n with a binary unit, e.g. "12.3 MB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// recordingStep is a terminal.Step that keeps every update.
+type recordingStep struct {
+	updates []string
+}
+
+func (s *recordingStep) TermOutput() io.Writer { return ioutil.Discard }
+func (s *recordingStep) Update(str string, args ...interface{}) {
+	s.updates = append(s.updates, fmt.Sprintf(str, args...))
+}
+func (s *recordingStep) Status(status string) {}
+func (s *recordingStep) Done()                {}
+func (s *recordingStep) Abort()               {}
+
+func TestWithProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3<<20)
+	a := &localArchive{
+		Size: int64(len(data)),
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		},
+	}
+	step := &recordingStep{}
+
+	r, err := a.withProgress(step, "Sending...").Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(step.updates) == 0 {
+		t.Fatal("no progress reported")
+	}
+	last := step.updates[len(step.updates)-1]
+	if !strings.HasPrefix(last, "Sending... 3.0 MB / 3.0 MB (100%), ") || !strings.HasSuffix(last, "/s") {
+		t.Errorf("unexpected final progress %q", last)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:             "0 B",
+		1023:          "1023 B",
+		1024:          "1.0 KB",
+		1536:          "1.5 KB",
+		500 << 20:     "500.0 MB",
+		3 << 30:       "3.0 GB",
+		(5 << 40) / 2: "2.5 TB",
+	}
+	for n, want := range cases {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
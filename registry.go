@@ -12,20 +12,30 @@ import (
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/jsonmessage"
-	"github.com/docker/docker/registry"
+	"github.com/fanatic/waypoint-plugin-heroku/heroku"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/waypoint-plugin-sdk/component"
 	"github.com/hashicorp/waypoint-plugin-sdk/terminal"
 	wpdocker "github.com/hashicorp/waypoint/builtin/docker"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type RegistryConfig struct {
 	Pipeline string `hcl:"pipeline,optional"`
 	App      string `hcl:"app,optional"`
+	APIKey   string `hcl:"api_key,optional"`
+
+	// ProcessTypes the image is pushed for, defaulting to web. Heroku runs
+	// each with the image's default command, ignoring the Procfile, so
+	// other types need an image that picks its command from $DYNO.
+	ProcessTypes []string `hcl:"process_types,optional"`
 }
 
+// herokuRegistry is Heroku's container registry.
+const herokuRegistry = "registry.heroku.com"
+
 type Registry struct {
 	config RegistryConfig
 }
@@ -46,7 +56,9 @@ func (r *Registry) push(
 	img *wpdocker.Image,
 	ui terminal.UI,
 	log hclog.Logger,
-) (*Artifact, error) {
+) (artifact *Artifact, err error) {
+	defer recoverPanic(log, &err)
+
 	stdout, _, err := ui.OutputWriters()
 	if err != nil {
 		return nil, status.Errorf(codes.FailedPrecondition, "unable to create output for logs:%s", err)
@@ -62,45 +74,22 @@ func (r *Registry) push(
 	}
 	cli.NegotiateAPIVersion(ctx)
 
-	target := "registry.heroku.com/" + r.config.App
-	step.Update("Tagging Docker image: %s => %s", img.Name(), target)
-
 	imgInspect, _, err := cli.ImageInspectWithRaw(ctx, img.Name())
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "unable to inspect image:%s", err)
 	}
 
-	err = cli.ImageTag(ctx, img.Name(), target)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "unable to tag image:%s", err)
+	processTypes := r.config.ProcessTypes
+	if len(processTypes) == 0 {
+		processTypes = []string{"web"}
 	}
+	log.Info("process types", "types", processTypes)
 
 	step.Done()
 
-	ref, err := reference.ParseNormalizedNamed(target)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "unable to parse image name: %s", err)
-	}
-
-	// Resolve the Repository name from fqn to RepositoryInfo
-	repoInfo, err := registry.ParseRepositoryInfo(ref)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "unable to parse repository info from image name: %s", err)
-	}
-
-	var server string
-
-	if repoInfo.Index.Official {
-		info, err := cli.Info(ctx)
-		if err != nil || info.IndexServerAddress == "" {
-			server = registry.IndexServer
-		} else {
-			server = info.IndexServerAddress
-		}
-	} else {
-		server = repoInfo.Index.Name
-	}
-
+	// Heroku's registry accepts the API key as the password for any
+	// username, so authenticate the same way the other components do and
+	// only fall back to `heroku container:login` credentials.
 	var errBuf bytes.Buffer
 	cf := config.LoadDefaultConfigFile(&errBuf)
 	if errBuf.Len() > 0 {
@@ -108,46 +97,70 @@ func (r *Registry) push(
 		log.Warn("error loading Docker config file", "err", err)
 	}
 
-	log.Info("server", server)
-	authConfig, _ := cf.GetAuthConfig(server)
+	authConfig, _ := cf.GetAuthConfig(herokuRegistry)
+	if apiKey, err := heroku.APIKey(r.config.APIKey); err == nil {
+		authConfig.Username = "_"
+		authConfig.Password = apiKey
+		authConfig.Auth = ""
+		authConfig.IdentityToken = ""
+	} else {
+		log.Warn("no Heroku credentials found, using Docker config", "err", err)
+		ui.Output("No Heroku API key found; pushing with the Docker credentials from `heroku container:login`",
+			terminal.WithWarningStyle())
+	}
 	buf, err := json.Marshal(authConfig)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "unable to generate authentication info for registry: %s", err)
 	}
 	encodedAuth := base64.URLEncoding.EncodeToString(buf)
 
-	step = sg.Add("Pushing Docker image...")
-
-	options := types.ImagePushOptions{
-		RegistryAuth: encodedAuth,
-	}
-
-	responseBody, err := cli.ImagePush(ctx, reference.FamiliarString(ref), options)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "unable to push image to registry: %s", err)
-	}
-
-	defer responseBody.Close()
-
 	var termFd uintptr
 	if f, ok := stdout.(*os.File); ok {
 		termFd = f.Fd()
 	}
 
-	err = jsonmessage.DisplayJSONMessagesStream(responseBody, step.TermOutput(), termFd, true, nil)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "unable to stream Docker logs to terminal: %s", err)
-	}
+	// Heroku takes the image of each process type from its own repository.
+	for _, processType := range processTypes {
+		target := herokuRegistry + "/" + r.config.App + "/" + processType
 
-	step.Done()
+		step = sg.Add("Tagging Docker image: %s => %s", img.Name(), target)
+		if err := cli.ImageTag(ctx, img.Name(), target); err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to tag image:%s", err)
+		}
+		ref, err := reference.ParseNormalizedNamed(target)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to parse image name: %s", err)
+		}
+		step.Done()
+
+		step = sg.Add("Pushing Docker image for %s...", processType)
+		responseBody, err := cli.ImagePush(ctx, reference.FamiliarString(ref), types.ImagePushOptions{
+			RegistryAuth: encodedAuth,
+		})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to push image to registry: %s", err)
+		}
+		err = jsonmessage.DisplayJSONMessagesStream(responseBody, step.TermOutput(), termFd, true, nil)
+		responseBody.Close()
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "unable to stream Docker logs to terminal: %s", err)
+		}
+		step.Done()
 
-	step = sg.Add("Docker image pushed: %s", target)
-	step.Done()
+		step = sg.Add("Docker image pushed: %s", target)
+		step.Done()
+	}
 
-	return &Artifact{ContainerImageDigest: imgInspect.ID}, nil
+	return &Artifact{
+		ContainerImageDigest: imgInspect.ID,
+		App:                  r.config.App,
+		ProcessTypes:         processTypes,
+		CreatedAt:            timestamppb.Now(),
+	}, nil
 }
 
 var (
-	_ component.Registry     = (*Registry)(nil)
-	_ component.Configurable = (*Registry)(nil)
+	_ component.Registry           = (*Registry)(nil)
+	_ component.Configurable       = (*Registry)(nil)
+	_ component.ConfigurableNotify = (*Registry)(nil)
 )
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"runtime/debug"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/waypoint-plugin-sdk/component"
@@ -27,12 +26,8 @@ func (r *Releaser) release(
 	job *component.JobInfo,
 	log hclog.Logger,
 	deployment *Deployment,
-) (*Release, error) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Error("Panic: %s %s", r, string(debug.Stack()))
-		}
-	}()
+) (release *Release, err error) {
+	defer recoverPanic(log, &err)
 
 	return &Release{
 		Url: deployment.Url,
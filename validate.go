@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fanatic/waypoint-plugin-heroku/heroku"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validFrom lists the values BuildConfig.From accepts.
+var validFrom = []string{"source", "archive", "url", "git", "existing"}
+
+// validateTimeout bounds the API calls made while validating configuration.
+var validateTimeout = 30 * time.Second
+
+// configProblems collects everything wrong with a component's configuration
+// so it can all be reported at once.
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// requireApp checks that app is set and that the credentials can access it
+// and any extra apps.
+func (p *configProblems) requireApp(apiKey, app string, extra ...string) {
+	if app == "" {
+		p.add("app is required")
+		return
+	}
+	p.checkApps(apiKey, false, append([]string{app}, extra...)...)
+}
+
+// checkApps verifies that the credentials are valid and can access each of
+// apps, which may be missing if missingOK is set.
+func (p *configProblems) checkApps(apiKey string, missingOK bool, apps ...string) {
+	h, err := heroku.New(apiKey)
+	if err != nil {
+		p.add("%s", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+	defer cancel()
+
+	for _, app := range apps {
+		if app == "" {
+			continue
+		}
+		_, err := h.AppInfo(ctx, app)
+		var apiErr *heroku.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized:
+			p.add("Heroku rejected the API key: %s", apiErr.Message)
+			return
+		case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusForbidden):
+			if missingOK && apiErr.StatusCode == http.StatusNotFound {
+				continue
+			}
+			p.add("app %q does not exist or the API key can't access it", app)
+		default:
+			p.add("checking app %q: %s", app, err)
+		}
+	}
+}
+
+// err returns the problems as an InvalidArgument error, or nil if there
+// are none.
+func (p configProblems) err(component string) error {
+	if len(p) == 0 {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "invalid heroku %s configuration:\n  %s",
+		component, strings.Join(p, "\n  "))
+}
+
+// fromList formats validFrom for error messages.
+func fromList() string {
+	return quoteList(validFrom)
+}
+
+// quoteList formats a list of valid values for error messages.
+func quoteList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigSet implements component.ConfigurableNotify.
+func (b *Builder) ConfigSet(interface{}) error {
+	var p configProblems
+
+	switch b.config.From {
+	case "":
+		p.add("from is required: one of %s", fromList())
+	case "url":
+		if u, err := url.Parse(b.config.URL); b.config.URL == "" || err != nil || u.Scheme != "https" || u.Host == "" {
+			p.add("url must be an HTTPS URL when from is \"url\", got %q", b.config.URL)
+		}
+	case "git":
+		if parts := strings.Split(b.config.Repo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			p.add("repo must be a GitHub repository like \"owner/name\" when from is \"git\", got %q", b.config.Repo)
+		}
+	case "source", "archive", "existing":
+	default:
+		p.add("from must be one of %s, got %q", fromList(), b.config.From)
+	}
+
+	// Env is set as config vars, which would release and restart the app
+	// serving traffic and leak into its runtime.
+	if len(b.config.Env) > 0 && b.buildApp() == b.config.App {
+		p.add("env requires a build_app other than app, as it is set as config vars on the app builds run on")
+	}
+
+	// Builds only need an app to build on, which may be the build app.
+	var extra []string
+	if b.config.BuildApp != "" {
+		extra = append(extra, b.config.App)
+	}
+	p.requireApp(b.config.APIKey, b.buildApp(), extra...)
+	return p.err("build")
+}
+
+// ConfigSet implements component.ConfigurableNotify.
+func (r *Registry) ConfigSet(interface{}) error {
+	var p configProblems
+	// Pushing only needs registry credentials, which may come from
+	// `heroku container:login` instead of an API key. Without a key the
+	// app can't be checked, and push warns about the fallback.
+	if _, err := heroku.APIKey(r.config.APIKey); err != nil {
+		if r.config.App == "" {
+			p.add("app is required")
+		}
+	} else {
+		p.requireApp(r.config.APIKey, r.config.App)
+	}
+	return p.err("registry")
+}
+
+// ConfigSet implements component.ConfigurableNotify.
+func (p *Platform) ConfigSet(interface{}) error {
+	var problems configProblems
+	if !contains(validOnDestroy, p.onDestroy()) {
+		problems.add("on_destroy must be one of %s, got %q", quoteList(validOnDestroy), p.config.OnDestroy)
+	}
+	if p.onDestroy() == "delete" && p.config.App != "" {
+		// Destroying a deployment deletes the app, which mustn't stop
+		// the workspace being destroyed again.
+		problems.checkApps(p.config.APIKey, true, p.config.App)
+	} else {
+		problems.requireApp(p.config.APIKey, p.config.App)
+	}
+	return problems.err("deploy")
+}
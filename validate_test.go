@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fanatic/waypoint-plugin-heroku/heroku"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBuilderConfigSet(t *testing.T) {
+	newTestServer(t)
+
+	cases := []struct {
+		name   string
+		config BuildConfig
+		want   []string
+	}{
+		{"valid", BuildConfig{From: "source", App: "example"}, nil},
+		{"build app only", BuildConfig{From: "existing", BuildApp: "example"}, nil},
+		{"missing everything", BuildConfig{}, []string{"from is required", "app is required"}},
+		{"unknown from", BuildConfig{From: "docker", App: "example"}, []string{`"source", "archive", "url", "git" or "existing", got "docker"`}},
+		{"bad url", BuildConfig{From: "url", App: "example", URL: "http://example.com/app.tgz"}, []string{"url must be an HTTPS URL"}},
+		{"bad repo", BuildConfig{From: "git", App: "example", Repo: "example"}, []string{"repo must be a GitHub repository"}},
+		{"missing app", BuildConfig{From: "source", App: "nope"}, []string{`app "nope" does not exist`}},
+		{"env without build app", BuildConfig{From: "source", App: "example", Env: map[string]string{"NODE_ENV": "production"}}, []string{"env requires a build_app"}},
+		{"env on build app", BuildConfig{From: "source", App: "example", BuildApp: "example", Env: map[string]string{"NODE_ENV": "production"}}, []string{"env requires a build_app"}},
+		{"missing deploy app", BuildConfig{From: "source", App: "nope", BuildApp: "example"}, []string{`app "nope" does not exist`}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b := &Builder{config: c.config}
+			checkProblems(t, b.ConfigSet(&b.config), c.want)
+		})
+	}
+}
+
+func TestPlatformAndRegistryConfigSet(t *testing.T) {
+	newTestServer(t)
+
+	p := &Platform{config: DeployConfig{App: "example"}}
+	checkProblems(t, p.ConfigSet(&p.config), nil)
+	p.config.App = ""
+	checkProblems(t, p.ConfigSet(&p.config), []string{"app is required"})
+	p.config = DeployConfig{App: "example", OnDestroy: "stop"}
+	checkProblems(t, p.ConfigSet(&p.config), []string{`on_destroy must be one of "rollback", "scale_down" or "delete", got "stop"`})
+	p.config = DeployConfig{App: "nope", OnDestroy: "delete"}
+	checkProblems(t, p.ConfigSet(&p.config), nil)
+	p.config.OnDestroy = "rollback"
+	checkProblems(t, p.ConfigSet(&p.config), []string{`app "nope" does not exist`})
+
+	r := &Registry{config: RegistryConfig{App: "nope"}}
+	checkProblems(t, r.ConfigSet(&r.config), []string{`app "nope" does not exist`})
+}
+
+func TestRegistryConfigSetWithoutAPIKey(t *testing.T) {
+	newTestServer(t)
+	setenv(t, heroku.EnvAPIKey, "")
+	home, err := ioutil.TempDir("", "waypoint-plugin-heroku-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+	setenv(t, "HOME", home)
+
+	// Docker credentials from `heroku container:login` are enough to push.
+	r := &Registry{config: RegistryConfig{App: "example"}}
+	checkProblems(t, r.ConfigSet(&r.config), nil)
+	r.config.App = ""
+	checkProblems(t, r.ConfigSet(&r.config), []string{"app is required"})
+
+	// The deploy still needs the API.
+	p := &Platform{config: DeployConfig{App: "example"}}
+	checkProblems(t, p.ConfigSet(&p.config), []string{"no Heroku credentials found"})
+}
+
+// checkProblems asserts that err is an InvalidArgument error mentioning each
+// of want, or nil if want is empty.
+func checkProblems(t *testing.T, err error, want []string) {
+	t.Helper()
+	if len(want) == 0 {
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an InvalidArgument error, got %v", err)
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("expected %q in:\n%s", w, err)
+		}
+	}
+}